@@ -3,6 +3,7 @@ const Delta = Quill.import("delta");
 
 const LAYOUT_ID = 0;
 const INITIAL_BACKOFF_MS = 1000;
+const SCROLL_DELAY_MS = 300;
 
 const STATE_DISCONNECTED = 0;
 const STATE_CONNECTED = 1;
@@ -89,13 +90,16 @@ export class Api {
     this.buffered_changes = {};
     this.acks = {};
     this.last = {};
+    this.nextActionId = 1;
+    this.pendingActions = {};
+    this.scrollTimer = null;
   }
 
   init(layout, onchange, onverify) {
     this.layout = layout;
     this.onchange = onchange;
     this.onverify = onverify;
-    this.connection = new Connection(({updates, hashes, selection}) => {
+    this.connection = new Connection(({updates, hashes, selection, results, layout}) => {
       updates = updates || [];
       for (const [id, update] of Object.entries(updates || {})) {
         const ack = this.acks[id] || 0;
@@ -126,15 +130,56 @@ export class Api {
       }
       const editorData = {};
       if (selection) {
+        const update = updates[selection.id];
+        const version = update ? update.version : this.acks[selection.id];
+        if (selection.version && selection.version !== version) {
+          console.log(`Selection version mismatch for file ${selection.id}, local: ${version}, remote: ${selection.version}`);
+        }
+        // Local changes not yet sent to server also need to be transformed.
+        const buffered = this.buffered_changes[selection.id];
+        if (buffered) {
+          const transformRange = ({index, length}) => {
+            const start = buffered.delta.transformPosition(index);
+            return {
+              index: start,
+              length: buffered.delta.transformPosition(index + length) - start
+            };
+          };
+          selection.range = transformRange(selection.range);
+          if (selection.ranges) {
+            selection.ranges = selection.ranges.map(transformRange);
+          }
+        }
         editorData.selection = selection;
       }
+      if (results) {
+        editorData.actions = [];
+        for (let { action_id, status, error, exit_code } of results) {
+          const pending = this.pendingActions[action_id];
+          if (!pending) { continue; }
+          delete this.pendingActions[action_id];
+          if (exit_code !== undefined) {
+            error = `${error} (exit code: ${exit_code})`;
+          }
+          editorData.actions.push({
+            id: pending.id,
+            running: false,
+            error: status === "failed" ? error : null
+          });
+        }
+      }
       const layoutUpdate = updates[LAYOUT_ID];
       if (layoutUpdate) {
         this.layout.update(layoutUpdate);
+        this.acks[LAYOUT_ID] = layoutUpdate.version;
+      }
+      if (layout) {
+        this.layout.updateClientLayout(layout);
+      }
+      if (layoutUpdate || layout) {
         editorData.layout = {
           columns: this.layout.columns
         };
-        this.acks[LAYOUT_ID] = layoutUpdate.version;
       }
       const knownIds = this.layout.knownIds();
       const knownUpdates = Object.values(updates).filter(update => knownIds.includes(update.id));
@@ -194,17 +239,6 @@ export class Api {
   }
 
   action(data) {
-    if (data) {
-      if (data.command === "Newcol") {
-        this.layout.createColumn();
-        this.onchange({layout: { columns: this.layout.columns }});
-        data = null;
-      } else if (data.command === "Delcol") {
-        this.layout.removeColumn(data.id - 1 + data.id % 2);
-        this.onchange({layout: { columns: this.layout.columns }});
-        data = null;
-      }
-    }
     // Move all possible buffered changes into inflight changes
     for (const { id, delta, base } of Object.values(this.buffered_changes)) {
       if (!this.inflight_changes[id]) {
@@ -218,10 +252,16 @@ export class Api {
       }
     }
     const hasLocalChanges = Object.keys(this.buffered_changes).length > 0;
+    if (data && !hasLocalChanges) {
+      data.action_id = this.nextActionId++;
+      this.pendingActions[data.action_id] = data;
+      this.onchange({ actions: [{ id: data.id, running: true }] });
+    }
     const payload = {
       action: hasLocalChanges ? null : data,
       changes: Object.values(this.inflight_changes),
       acks: this.acks,
+      sizes: this.layout.grabSizes(),
     };
     const dirtyChanges = {};
     Object.keys(this.inflight_changes).forEach(id => {
@@ -235,11 +275,22 @@ export class Api {
   }
 
   move({id, x, y}) {
-    this.layout.move(id, x, y);
-    this.onchange({ layout: { columns: this.layout.columns } });
+    this.connection.send({
+      move: { id, x, y },
+      acks: this.acks,
+    });
   }
 
   sizechange(sizes) {
     this.layout.updateSizes(sizes);
   }
+
+  scrollchange(id, top) {
+    if (this.layout.updateTop(id, top) && !this.scrollTimer) {
+      this.scrollTimer = setTimeout(() => {
+        this.scrollTimer = null;
+        this.action(null);
+      }, SCROLL_DELAY_MS);
+    }
+  }
 }
@@ -16,6 +16,7 @@ const ACTIONS = {
 Object.freeze(ACTIONS);
 
 const ACTION_SELECTION_EXPAND_LENGTH = 256;
+const HIGHLIGHT_COLOR = "#eeee9e";
 function generate_action(action, editor, { index, length }, api, oldSelection) {
   if (!oldSelection) {
     // Use current command selection in case old selection does not exist
@@ -246,7 +247,7 @@ export class Window {
     return target;
   }
 
-  update({layout, rows, dirtyChanges, selection}) {
+  update({layout, rows, dirtyChanges, selection, actions}) {
     if (layout) {
       // Saving scroll positions for existing rows when layout needs changes.
       this.rows.views.forEach(row => {
@@ -310,6 +311,17 @@ export class Window {
         row.update({ selection })
       }
     }
+
+    if (actions) {
+      const { lookup } = this.rows;
+      actions.forEach(function(action) {
+        const id = action.id - 1 + action.id % 2;
+        const row = lookup[id];
+        if (row) {
+          row.update({ action });
+        }
+      });
+    }
   }
 
   onselection(id, selection) {
@@ -343,6 +355,11 @@ export class Row {
 
     this.labelEditor = new Quill(this.label);
     this.contentEditor = new Quill(this.content);
+    // Look highlights are drawn over the editor instead of formatting text,
+    // so they never end up in the shared document.
+    this.highlights = el(".highlights");
+    this.content.appendChild(this.highlights);
+    this.highlightRanges = [];
 
     this.resizer.__id = this.id;
 
@@ -353,6 +370,7 @@ export class Row {
     this.content.__version = 0;
 
     this.contentEditor.lastSelection = null;
+    this.runningActions = 0;
 
     this.labelEditor.on("text-change", (delta, _oldDelta, source) => {
       if (source === "user") {
@@ -363,6 +381,13 @@ export class Row {
       if (source === "user") {
         api.textchange(this.content.__id, delta, this.content.__version);
       }
+      if (this.highlightRanges.length > 0) {
+        this.highlightRanges = this.highlightRanges.map(({index, length}) => {
+          const start = delta.transformPosition(index);
+          return {index: start, length: delta.transformPosition(index + length) - start};
+        });
+        this.drawHighlights();
+      }
     });
     this.labelEditor.on("selection-change", (selection) => {
       root.onselection(this.label.__id, selection);
@@ -370,11 +395,52 @@ export class Row {
     this.contentEditor.on("selection-change", (selection) => {
       root.onselection(this.content.__id, selection);
     });
+    // Paged windows of huge files load more pages as they are scrolled.
+    this.contentEditor.root.addEventListener("scroll", () => {
+      api.scrollchange(this.content.__id, this.topIndex());
+      this.drawHighlights();
+    });
+  }
+
+  // Each line of a range gets its own box, so multi-line ranges do not
+  // cover unrelated text.
+  drawHighlights() {
+    const editor = this.contentEditor;
+    const boxes = [];
+    this.highlightRanges.forEach(({index, length}) => {
+      editor.getLines(index, length).forEach((line) => {
+        const lineIndex = editor.getIndex(line);
+        const start = Math.max(index, lineIndex);
+        const end = Math.min(index + length, lineIndex + line.length() - 1);
+        if (end > start) {
+          const {left, top, width, height} = editor.getBounds(start, end - start);
+          boxes.push(el(".highlight", {style: {
+            left: `${left}px`,
+            top: `${top}px`,
+            width: `${width}px`,
+            height: `${height}px`,
+            backgroundColor: HIGHLIGHT_COLOR
+          }}));
+        }
+      });
+    });
+    setChildren(this.highlights, boxes);
   }
 
-  update({height, change, dirty, selection}) {
+  topIndex() {
+    const scrollElement = this.contentEditor.root;
+    for (const child of scrollElement.children) {
+      if (child.offsetTop + child.offsetHeight > scrollElement.scrollTop) {
+        return this.contentEditor.getIndex(Quill.find(child));
+      }
+    }
+    return 0;
+  }
+
+  update({height, change, dirty, selection, action}) {
     if (height) {
       setStyle(this.el, {height: `${height}%`});
+      this.drawHighlights();
     }
     if (change) {
       const id = change.id;
@@ -404,9 +470,22 @@ export class Row {
       }
     }
     if (selection) {
+      this.highlightRanges = selection.ranges || [];
+      this.drawHighlights();
       this.contentEditor.setSelection(selection.range.index,
                                       selection.range.length);
     }
+    if (action) {
+      this.runningActions = Math.max(0, this.runningActions + (action.running ? 1 : -1));
+      this.resizer.classList.toggle("running", this.runningActions > 0);
+      if (action.running) {
+        this.resizer.classList.remove("failed");
+        this.resizer.title = "";
+      } else if (action.error) {
+        this.resizer.classList.add("failed");
+        this.resizer.title = action.error;
+      }
+    }
   }
 
   verify(id, hash) {
@@ -443,56 +522,17 @@ export class Row {
   }
 }
 
-let nextColumnId = 1;
-function columnId() {
-  return nextColumnId++;
-}
-
+// Layout is maintained at server side, see layout.go for the format. When
+// per-client layout is enabled, the layout sent in updates takes precedence
+// over the one from meta file.
 export class Layout {
   constructor() {
     this.version = 0;
     this.data = new Delta();
+    this.clientLayout = null;
     this.sizes = {};
     this.dirty = false;
-    this.columns = [
-      {
-        id: columnId(),
-        width: 50,
-        rows: []
-      },
-      {
-        id: columnId(),
-        width: 50,
-        rows: []
-      }
-    ];
-  }
-
-  createColumn() {
-    const column = {
-      id: columnId(),
-      width: this.columns[this.columns.length - 1].width / 2,
-      rows: []
-    };
-    this.columns[this.columns.length - 1].width -= column.width;
-    this.columns.push(column);
-  }
-
-  removeColumn(rowId) {
-    if (this.columns.length === 1) {
-      return;
-    }
-    const columnIndex = this.columns.findIndex(column => {
-      return column.rows.findIndex(row => row.id === rowId) !== -1;
-    });
-    if (columnIndex !== -1) {
-      const column = this.columns[columnIndex];
-      this.columns.splice(columnIndex, 1);
-      this.columns[this.columns.length - 1].width += column.width;
-      column.rows.forEach(row => {
-        this._createRow(row.id);
-      });
-    }
+    this.columns = [];
   }
 
   verify(hash) {
@@ -500,25 +540,31 @@ export class Layout {
   }
 
   update(change) {
-    this.version = Math.max(this.version, change.version);
-    this.data = this.data.compose(new Delta(change.delta));
+    if (change) {
+      this.version = Math.max(this.version, change.version);
+      this.data = this.data.compose(new Delta(change.delta));
+    }
+    const oldIds = this._currentIds();
+    this.columns = this._parse(this.clientLayout || this._text());
     const currentIds = this._currentIds();
-    const oldIds = [].concat(...this.columns.map(column => column.rows.map(row => row.id)));
     const addedIds = currentIds.filter(id => !oldIds.includes(id));
     const deletedIds = oldIds.filter(id => !currentIds.includes(id));
     deletedIds.forEach(id => {
-      this._deleteRow(id);
       delete this.sizes[id];
       delete this.sizes[id + 1];
     });
     addedIds.forEach(id => {
-      this._createRow(id);
       this.sizes[id] = { columns: 0, rows: 0 };
       this.sizes[id + 1] = { columns: 0, rows: 0 };
     });
     return addedIds.length > 0 || deletedIds.length > 0;
   }
 
+  updateClientLayout(layout) {
+    this.clientLayout = layout;
+    return this.update(null);
+  }
+
   updateSizes(sizes) {
     Object.keys(sizes).forEach(id => {
       const { columns, rows } = sizes[id];
@@ -532,169 +578,62 @@ export class Layout {
     });
   }
 
-  move(id, x, y) {
-    const source = this._locateEditorById(id);
-    const target = this._locateEditorByPosition(x, y);
-
-    if (!(source && target)) {
-      return;
+  updateTop(id, top) {
+    if (this.sizes[id] && this.sizes[id].top !== top) {
+      this.sizes[id].top = top;
+      this.dirty = true;
     }
+    return this.dirty;
+  }
 
-    if (source.row === 0 && target.row === 0 &&
-        source.column === target.column &&
-        target.position < 5) {
-      /* Shrinking column */
-      if (target.column > 0) {
-        this.columns[target.column - 1].width += target.xPosition;
-        this.columns[target.column].width -= target.xPosition;
-      }
-    } else if (source.row === 0 && target.row === 0 &&
-               source.column === target.column + 1 &&
-               target.position < 5) {
-      /* Enlarging column */
-      const diff = this.columns[target.column].width - target.xPosition;
-      this.columns[target.column].width -= diff;
-      this.columns[source.column].width += diff;
-    } else if (source.column === target.column &&
-        source.row === target.row) {
-      /* Shrinking row */
-      if (target.row > 0) {
-        this.columns[target.column].rows[target.row - 1].height += target.position;
-        this.columns[target.column].rows[target.row].height -= target.position;
-      }
-    } else if (source.column === target.column &&
-               source.row === target.row + 1) {
-      /* Enlarging row */
-      const diff = this.columns[target.column].rows[target.row].height - target.position;
-      this.columns[target.column].rows[target.row].height -= diff;
-      this.columns[source.column].rows[source.row].height += diff;
-    } else if (target.row === -1) {
-      /* Moving row to an empty column */
-      this._deleteRow(id);
-      this.columns[target.column].rows.splice(0, 0, {
-        height: 100,
-        id,
-      });
-    } else {
-      /* Moving row to a new location */
-      const targetId = this.columns[target.column].rows[target.row].id;
-      this._deleteRow(id);
-      const newTargetRow = this.columns[target.column].rows.findIndex(({id}) => id === targetId);
-      if (newTargetRow === -1) {
-        console.log("Unexpected!");
-        return;
-      }
-      const remaining = this.columns[target.column].rows[newTargetRow].height - target.position;
-      this.columns[target.column].rows[newTargetRow].height = target.position;
-      this.columns[target.column].rows.splice(newTargetRow + 1, 0, {
-        height: remaining,
-        id,
-      });
+  grabSizes() {
+    if (!this.dirty) {
+      return null;
     }
+    this.dirty = false;
+    return Object.keys(this.sizes).map(id => {
+      const { columns, rows, top } = this.sizes[id];
+      return { id: parseInt(id, 10), width: columns, height: rows, top: top || 0 };
+    });
   }
 
   knownIds() {
-    return this.data.filter(op => typeof op.insert === "string")
-                           .map(op => op.insert)
-                           .join("")
-                           .split("\n")
-                           .map(line => parseInt(line, 10));
-  }
-
-  _currentIds() {
-    return this.knownIds().filter(id => id > 0 && id % 2 !== 0);
-  }
-
-  _locateEditorById(id) {
-    for (const [columnIndex, column] of this.columns.entries()) {
-      for (const [rowIndex, row] of column.rows.entries()) {
-        if (row.id === id) {
-          return {
-            column: columnIndex,
-            row: rowIndex,
-          };
-        }
-      }
-    }
-    return null;
+    const ids = [0];
+    this._parse(this._text()).forEach(({rows}) => {
+      rows.forEach(({id}) => {
+        ids.push(id, id + 1);
+      });
+    });
+    return ids;
   }
 
-  _locateEditorByPosition(x, y) {
-    let targetColumn = -1;
-    let currentWidth = 0;
-    for (const [columnIndex, column] of this.columns.entries()) {
-      if (x < currentWidth + column.width) {
-        targetColumn = columnIndex;
-        break;
-      }
-      currentWidth += column.width;
-    }
-    if (targetColumn === -1) {
-      console.error("Cannot locate dropped column!");
-      return null;
-    }
-
-    let targetRow = -1;
-    let currentHeight = 0;
-    for (const [rowIndex, row] of this.columns[targetColumn].rows.entries()) {
-      if (y < currentHeight + row.height) {
-        targetRow = rowIndex;
-        break;
-      }
-      currentHeight += row.height;
-    }
-
-    return {
-      column: targetColumn,
-      row: targetRow,
-      position: y - currentHeight,
-      xPosition: x - currentWidth,
-    };
+  _text() {
+    return this.data.filter(op => typeof op.insert === "string")
+                    .map(op => op.insert)
+                    .join("");
   }
 
-  _createRow(rowId) {
-    let columnIndex = -1;
-    let columnSpareHeight = 0;
-
-    this.columns.forEach(function(column, idx) {
-      let currentHeight = 100;
-      if (column.rows.length > 0) {
-        currentHeight = column.rows[column.rows.length - 1].height / 2;
-      }
-      if (currentHeight > columnSpareHeight) {
-        columnIndex = idx;
-        columnSpareHeight = currentHeight;
+  _parse(text) {
+    const columns = [];
+    text.split("\n").forEach(line => {
+      const fields = line.split(" ").filter(field => field.length > 0);
+      if (fields.length === 0) { return; }
+      const id = parseInt(fields[0], 10);
+      if (id === 0) {
+        fields.slice(1).forEach(width => {
+          columns.push({ width: parseFloat(width), rows: [] });
+        });
+      } else if (fields.length === 3 && columns[parseInt(fields[1], 10)]) {
+        columns[parseInt(fields[1], 10)].rows.push({
+          id,
+          height: parseFloat(fields[2])
+        });
       }
     });
-
-    if (columnIndex === -1) {
-      console.error("Cannot find column to insert!");
-      return;
-    }
-
-    const column = this.columns[columnIndex];
-    if (column.rows.length > 0) {
-      column.rows[column.rows.length - 1].height -= columnSpareHeight;
-    }
-    column.rows.push({
-      height: columnSpareHeight,
-      id: rowId
-    });
-    return rowId;
+    return columns;
   }
 
-  _deleteRow(rowId) {
-    this.columns.forEach(function(column) {
-      const index = column.rows.findIndex(function(row) {
-        return row.id === rowId;
-      });
-      if (index !== -1) {
-        const growIndex = index === 0 ? index + 1 : index - 1;
-        if (growIndex < column.rows.length) {
-          column.rows[growIndex].height += column.rows[index].height;
-        }
-        column.rows.splice(index, 1);
-      }
-    });
+  _currentIds() {
+    return [].concat(...this.columns.map(column => column.rows.map(row => row.id)));
   }
 }
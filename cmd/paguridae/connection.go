@@ -4,8 +4,10 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"os/exec"
 	"sync"
 	"time"
 
@@ -18,8 +20,18 @@ type Connection struct {
 	id              uuid.UUID
 	session         *Session
 	flushChan       <-chan bool
+	actionChan      chan bool
 	bufferedUpdates map[uint32]ot.ServerUpdate
-	mux             sync.Mutex
+	bufferedResults []ActionResult
+	// Actions waiting to run, keyed by content file of the window they
+	// are executed in.
+	queuedActions map[uint32][]Action
+	// Selection produced by the latest finished action, waiting to be picked
+	// up by the serving loop.
+	selection        *Selection
+	selectionCreated bool
+	layoutVersion    uint32
+	mux              sync.Mutex
 }
 
 func NewConnection(clientId *uuid.UUID, session *Session) *Connection {
@@ -29,7 +41,9 @@ func NewConnection(clientId *uuid.UUID, session *Session) *Connection {
 		id:              id,
 		session:         session,
 		flushChan:       flushChan,
+		actionChan:      make(chan bool, 1),
 		bufferedUpdates: make(map[uint32]ot.ServerUpdate),
+		queuedActions:   make(map[uint32][]Action),
 	}
 	go func(c *Connection) {
 		for event := range userEvents {
@@ -67,6 +81,97 @@ func (c *Connection) GrabUpdates() map[uint32]ot.ServerUpdate {
 	return updates
 }
 
+func (c *Connection) GrabResults() ([]ActionResult, *Selection, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	results, selection, selectionCreated := c.bufferedResults, c.selection, c.selectionCreated
+	c.bufferedResults = nil
+	c.selection, c.selectionCreated = nil, false
+	return results, selection, selectionCreated
+}
+
+func exitCode(err error) *int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		return &code
+	}
+	return nil
+}
+
+// Actions might take a long time to finish(e.g., running external commands),
+// so they are executed outside of the serving loop, results are then sent
+// back in the next update.
+func (c *Connection) runAction(action Action) {
+	aSelection, aSelectionCreated, err := c.session.Execute(c.id, action)
+	var running *runningCommand
+	if errors.As(err, &running) {
+		// Window is released for other actions while the command runs
+		go func() {
+			c.reportAction(action, nil, false, <-running.done)
+		}()
+		return
+	}
+	c.reportAction(action, aSelection, aSelectionCreated, err)
+}
+
+func (c *Connection) reportAction(action Action, aSelection *Selection, aSelectionCreated bool, err error) {
+	result := ActionResult{
+		ActionId: action.ActionId,
+		Status:   ActionDone,
+	}
+	if err != nil {
+		log.Print("Error executing action:", err)
+		result.Status = ActionFailed
+		result.Error = err.Error()
+		result.ExitCode = exitCode(err)
+	}
+
+	c.mux.Lock()
+	if aSelection != nil {
+		c.selection, c.selectionCreated = aSelection, aSelectionCreated
+	}
+	if action.ActionId != 0 {
+		c.bufferedResults = append(c.bufferedResults, result)
+	}
+	c.mux.Unlock()
+
+	select {
+	case c.actionChan <- true:
+	default:
+	}
+}
+
+// Actions of the same window run in order, one after another, while actions
+// of different windows run concurrently, so a long running command in one
+// window won't block others.
+func (c *Connection) queueAction(action Action) {
+	key := action.ContentId()
+	c.mux.Lock()
+	queue, running := c.queuedActions[key]
+	c.queuedActions[key] = append(queue, action)
+	c.mux.Unlock()
+	if !running {
+		go c.drainActions(key)
+	}
+}
+
+func (c *Connection) drainActions(key uint32) {
+	for {
+		c.mux.Lock()
+		queue := c.queuedActions[key]
+		if len(queue) == 0 {
+			delete(c.queuedActions, key)
+			c.mux.Unlock()
+			return
+		}
+		c.queuedActions[key] = queue[1:]
+		c.mux.Unlock()
+		c.runAction(queue[0])
+	}
+}
+
 func (c *Connection) Serve(ctx context.Context, socketConn *websocket.Conn) error {
 	log.Printf("Serving connection %s", c.id)
 	messageChan := make(chan []byte)
@@ -100,25 +205,39 @@ func (c *Connection) Serve(ctx context.Context, socketConn *websocket.Conn) erro
 			if err != nil {
 				log.Print("Error applying changes:", err)
 			}
-			if request.Action != nil {
-				aSelection, aSelectionCreated, err := c.session.Execute(c.id, *request.Action)
+			if len(request.Sizes) > 0 {
+				c.session.UpdateSizes(request.Sizes)
+			}
+			if request.Move != nil {
+				err = c.session.MoveWindow(c.id, *request.Move)
 				if err != nil {
-					log.Print("Error executing action:", err)
-				} else if aSelection != nil {
-					selection, selectionCreated = aSelection, aSelectionCreated
+					log.Print("Error moving window:", err)
 				}
 			}
+			if request.Action != nil {
+				c.queueAction(*request.Action)
+			}
+			timeout = 10 * time.Millisecond
+		case <-c.actionChan:
 			timeout = 10 * time.Millisecond
 		case <-c.flushChan:
 			timeout = 10 * time.Millisecond
 		case err := <-errorChan:
 			return err
+		case <-c.session.Exiting():
+			return nil
 		case <-time.After(timeout):
 			timeout = timeout * 2
 		}
 
 		updates := c.GrabUpdates()
-		if len(updates) > 0 || selection != nil {
+		results, aSelection, aSelectionCreated := c.GrabResults()
+		if aSelection != nil {
+			selection, selectionCreated = aSelection, aSelectionCreated
+		}
+		layout, layoutVersion := c.session.ClientLayout(c.id, c.layoutVersion)
+		c.layoutVersion = layoutVersion
+		if len(updates) > 0 || len(results) > 0 || len(layout) > 0 || selection != nil {
 			var hashes map[uint32]Hash
 			if c.session.VerifyContent {
 				hashes = make(map[uint32]Hash)
@@ -145,11 +264,22 @@ func (c *Connection) Serve(ctx context.Context, socketConn *websocket.Conn) erro
 			updateData := Update{
 				Updates: updates,
 				Hashes:  hashes,
+				Results: results,
+				Layout:  layout,
 			}
 			if selection != nil {
-				_, ok := updateData.Updates[selection.Id]
+				update, ok := updateData.Updates[selection.Id]
 				if (!selectionCreated) || ok {
-					updateData.Selection = selection
+					// Selection is transformed to the version the client will
+					// have after applying this update.
+					target := update.Version
+					if !ok {
+						if content := c.session.Server.Content(selection.Id); content != nil {
+							target = content.Version
+						}
+					}
+					transformed := c.session.TransformSelection(*selection, target)
+					updateData.Selection = &transformed
 					selection = nil
 				}
 			}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const DirectoryLabel = " | New Del Ls"
+
+// Options for listing a directory window, set via "Ls [-a] [-l] [-t|-S]":
+// -a shows dotfiles, -l uses long format, -t sorts by modification time and
+// -S sorts by size, both starting from the largest.
+type listingOptions struct {
+	sortBy string
+	hidden bool
+	long   bool
+}
+
+func parseListingOptions(args []string) (listingOptions, error) {
+	options := listingOptions{sortBy: "name"}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return options, fmt.Errorf("Invalid Ls option: %s", arg)
+		}
+		for _, c := range arg[1:] {
+			switch c {
+			case 'a':
+				options.hidden = true
+			case 'l':
+				options.long = true
+			case 't':
+				options.sortBy = "mtime"
+			case 'S':
+				options.sortBy = "size"
+			default:
+				return options, fmt.Errorf("Invalid Ls option: -%c", c)
+			}
+		}
+	}
+	return options, nil
+}
+
+func isDirectory(storage Storage, path string) bool {
+	stat, err := storage.Stat(path)
+	return err == nil && stat.IsDir()
+}
+
+// Directories are suffixed with "/", no other markers are added so all
+// entries stay clickable.
+func listEntries(storage Storage, path string, options listingOptions) ([]string, error) {
+	infos, err := storage.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	switch options.sortBy {
+	case "mtime":
+		sort.SliceStable(infos, func(i, j int) bool {
+			return infos[i].ModTime().After(infos[j].ModTime())
+		})
+	case "size":
+		sort.SliceStable(infos, func(i, j int) bool {
+			return infos[i].Size() > infos[j].Size()
+		})
+	}
+	entries := make([]string, 0, len(infos))
+	for _, info := range infos {
+		name := info.Name()
+		if !options.hidden && strings.HasPrefix(name, ".") {
+			continue
+		}
+		if info.IsDir() || (info.Mode()&os.ModeSymlink != 0 && isDirectory(storage, path+name)) {
+			name += "/"
+		}
+		if options.long {
+			name = fmt.Sprintf("%s %10d %s %s", info.Mode(), info.Size(),
+				info.ModTime().Format("2006-01-02 15:04"), name)
+		}
+		entries = append(entries, name)
+	}
+	return entries, nil
+}
+
+// For directories, partial loading ranges count entries instead of bytes,
+// the total number of entries is also returned.
+func listDirectory(storage Storage, pathInfo fullPathInfo, options listingOptions) (string, int, error) {
+	entries, err := listEntries(storage, pathInfo.path+"/", options)
+	if err != nil {
+		return "", 0, err
+	}
+	total := len(entries)
+	if pathInfo.partialLoad() {
+		start := int(*pathInfo.start)
+		if start > len(entries) {
+			start = len(entries)
+		}
+		end := start + int(*pathInfo.length)
+		if end > len(entries) {
+			end = len(entries)
+		}
+		entries = entries[start:end]
+	}
+	if len(entries) == 0 {
+		return "", total, nil
+	}
+	return strings.Join(entries, "\n") + "\n", total, nil
+}
+
+func (s *Session) listingOptions(contentId uint32) listingOptions {
+	bufferId := s.bufferId(contentId)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if options, ok := s.listings[bufferId]; ok {
+		return options
+	}
+	options, _ := parseListingOptions(nil)
+	return options
+}
+
+// Directories with more than one page of entries are paginated, Next and
+// Prev then work like they do with partially loaded files.
+func (s *Session) CreateDirectoryListingFile(pathInfo fullPathInfo) error {
+	options, _ := parseListingOptions(nil)
+	return s.createListing(s.Storage(), pathInfo, options)
+}
+
+func (s *Session) createListing(storage Storage, pathInfo fullPathInfo, options listingOptions) error {
+	entries, err := listEntries(storage, pathInfo.path+"/", options)
+	if err != nil {
+		return err
+	}
+	label := fmt.Sprintf("%s/%s", strings.TrimSuffix(pathInfo.path, "/"), DirectoryLabel)
+	if pathInfo.partialLoad() || len(entries) > *directoryPageSize {
+		if !pathInfo.partialLoad() {
+			start, length := int64(0), int64(*directoryPageSize)
+			pathInfo.start, pathInfo.length = &start, &length
+		}
+		label = fmt.Sprintf("(%d,%d,%d)%s", *pathInfo.start, *pathInfo.length, len(entries), label)
+	}
+	content, _, err := listDirectory(storage, pathInfo, options)
+	if err != nil {
+		return err
+	}
+	contentId, err := s.createFile(label, &content)
+	if err != nil {
+		return err
+	}
+	s.bindStorage(contentId, storage)
+	if defaultOptions, _ := parseListingOptions(nil); options != defaultOptions {
+		s.mux.Lock()
+		s.listings[contentId] = options
+		s.mux.Unlock()
+	}
+	s.recordDiskState(contentId, pathInfo, content, fileFormat{})
+	return nil
+}
+
+// Pages keep listing options of the window, and never start beyond the last
+// entry.
+func (s *Session) pageDirectoryListing(contentId uint32, pathInfo fullPathInfo, next bool) error {
+	options := s.listingOptions(contentId)
+	storage := s.windowStorage(contentId)
+	entries, err := listEntries(storage, pathInfo.path+"/", options)
+	if err != nil {
+		return err
+	}
+	page := int64(*directoryPageSize)
+	start := *pathInfo.start + page
+	if !next {
+		start = *pathInfo.start - page
+	}
+	if last := (int64(len(entries)) - 1) / page * page; start > last {
+		start = last
+	}
+	if start < 0 {
+		start = 0
+	}
+	pathInfo.start, pathInfo.length = &start, &page
+	return s.createListing(storage, pathInfo, options)
+}
+
+// Ls re-lists a directory window with new options, which are kept for later
+// refreshes of the window.
+func (s *Session) relistDirectory(contentId uint32, pathInfo fullPathInfo, args []string) error {
+	if !isDirectory(s.windowStorage(contentId), pathInfo.path) {
+		return fmt.Errorf("%s is not a directory", pathInfo.path)
+	}
+	options, err := parseListingOptions(args)
+	if err != nil {
+		return err
+	}
+	bufferId := s.bufferId(contentId)
+	s.mux.Lock()
+	s.listings[bufferId] = options
+	s.mux.Unlock()
+	return s.reloadFile(contentId, pathInfo)
+}
+
+// Read current content of a window from disk, respecting listing options
+// of directory windows. Total entries in labels of paginated listings are
+// updated, since options and directory changes both affect them.
+func (s *Session) readWindow(contentId uint32, pathInfo fullPathInfo) (string, fileFormat, error) {
+	storage := s.windowStorage(contentId)
+	if isDirectory(storage, pathInfo.path) {
+		content, total, err := listDirectory(storage, pathInfo, s.listingOptions(contentId))
+		if err == nil && pathInfo.partialLoad() {
+			err = s.setPageRange(contentId-1, *pathInfo.start, *pathInfo.length, int64(total))
+		}
+		return content, fileFormat{}, err
+	}
+	return readPath(storage, pathInfo)
+}
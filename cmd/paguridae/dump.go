@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+	"xuejie.space/c/paguridae/pkg/ot"
+)
+
+const DefaultDumpFile = "paguridae.dump"
+
+// Windows are dumped in layout order. Content is only kept for windows
+// that cannot be restored from disk: scratch windows, dirty windows, and
+// windows whose path does not exist, such as +Errors.
+type dumpedWindow struct {
+	Label   string  `json:"label"`
+	Path    string  `json:"path"`
+	Content *string `json:"content,omitempty"`
+	Column  int     `json:"column"`
+	Height  float64 `json:"height"`
+}
+
+type sessionDump struct {
+	Widths  []float64      `json:"widths"`
+	Windows []dumpedWindow `json:"windows"`
+}
+
+// Dump file defaults to $HOME/paguridae.dump, relative paths are resolved
+// from current window's directory.
+func dumpFilePath(storage Storage, pathInfo fullPathInfo, args []string) (string, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, DefaultDumpFile), nil
+	}
+	if filepath.IsAbs(args[0]) {
+		return args[0], nil
+	}
+	return filepath.Join(windowDirectory(storage, pathInfo), args[0]), nil
+}
+
+func (s *Session) Dump(file string) error {
+	layout, err := s.sharedLayout()
+	if err != nil {
+		return err
+	}
+	contents := make(map[uint32]delta.Delta)
+	for _, change := range s.Server.AllContents() {
+		contents[change.Id] = change.Delta
+	}
+	dump := sessionDump{}
+	for i, column := range layout.Columns {
+		dump.Widths = append(dump.Widths, column.Width)
+		for _, row := range column.Rows {
+			label, ok := contents[row.Id]
+			if !ok {
+				continue
+			}
+			window := dumpedWindow{
+				Label:  DeltaToString(label, false),
+				Path:   extractFullPath(label),
+				Column: i,
+				Height: row.Height,
+			}
+			_, statErr := s.windowStorage(row.Id + 1).Stat(parseFullPath(window.Path).path)
+			if len(window.Path) == 0 || statErr != nil || isDirtyLabel(window.Label) {
+				content := DeltaToString(contents[row.Id+1], false)
+				window.Content = &content
+			}
+			dump.Windows = append(dump.Windows, window)
+		}
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// Load replaces all windows in current session with windows from the dump
+// file, windows that fail to load are reported in +Errors.
+func (s *Session) Load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var dump sessionDump
+	err = json.Unmarshal(data, &dump)
+	if err != nil {
+		return err
+	}
+	s.closeAllFiles()
+	layout := &Layout{}
+	for _, width := range dump.Widths {
+		layout.Columns = append(layout.Columns, LayoutColumn{Width: width})
+	}
+	if len(layout.Columns) == 0 {
+		layout = NewLayout()
+	}
+	for _, window := range dump.Windows {
+		content := window.Content
+		pathInfo := parseFullPath(window.Path)
+		var format fileFormat
+		if content == nil {
+			var data string
+			var err error
+			data, format, err = readPath(s.Storage(), pathInfo)
+			if err != nil {
+				fmt.Fprintf(s.newErrorBuffer(nil), "Error loading %s: %v\n", window.Path, err)
+				continue
+			}
+			content = &data
+		}
+		contentId, err := s.createFile(window.Label, content)
+		if err != nil {
+			return err
+		}
+		if window.Content == nil {
+			s.recordDiskState(contentId, pathInfo, *content, format)
+		}
+		if window.Column >= 0 && window.Column < len(layout.Columns) {
+			layout.Columns[window.Column].Rows = append(layout.Columns[window.Column].Rows, LayoutRow{
+				Id:     contentId - 1,
+				Height: window.Height,
+			})
+		} else {
+			layout.CreateRow(contentId - 1)
+		}
+	}
+	return s.Server.UpdateAll(func(changes []ot.ServerUpdate) ([]ot.ClientChange, error) {
+		var oldMeta *ot.ServerUpdate
+		labelIds := make([]uint32, 0)
+		for i, change := range changes {
+			if change.Id == MetaFileId {
+				oldMeta = &changes[i]
+			} else if change.Id%2 != 0 {
+				labelIds = append(labelIds, change.Id)
+			}
+		}
+		if oldMeta == nil {
+			return nil, fmt.Errorf("Metafile does not exist, something is seriously wrong!")
+		}
+		// Windows created during loading, such as +Errors, also need a place
+		layout.Sync(labelIds)
+		return []ot.ClientChange{
+			{
+				Id:    MetaFileId,
+				Delta: *Diff(oldMeta.Delta, layout.Delta()),
+				Base:  oldMeta.Version,
+			},
+		}, nil
+	})
+}
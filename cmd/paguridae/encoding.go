@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+const BinarySniffLength = 8000
+
+var utf8Bom = []byte{0xEF, 0xBB, 0xBF}
+
+// Windows always hold UTF-8 content with "\n" line endings, format records
+// how a file is stored on disk so Put can convert content back. Invalid
+// UTF-8 is read as Latin-1, which maps each byte to one rune, so any such
+// file survives a round trip unchanged. CRLF is only converted when every
+// line ends with it, mixed line endings are kept as they are.
+type fileFormat struct {
+	latin1 bool
+	bom    bool
+	crlf   bool
+}
+
+// Like git, a NUL byte near the start means binary content.
+func isBinary(data []byte) bool {
+	if len(data) > BinarySniffLength {
+		data = data[:BinarySniffLength]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
+
+func decodeContent(data []byte) (string, fileFormat, error) {
+	var format fileFormat
+	if isBinary(data) {
+		return "", format, errors.New("binary files cannot be opened")
+	}
+	if bytes.HasPrefix(data, utf8Bom) {
+		format.bom = true
+		data = data[len(utf8Bom):]
+	}
+	var content string
+	if utf8.Valid(data) {
+		content = string(data)
+	} else {
+		format.latin1 = true
+		content = decodeLatin1(data)
+	}
+	lines := strings.Count(content, "\n")
+	if lines > 0 && strings.Count(content, "\r\n") == lines {
+		format.crlf = true
+		content = strings.Replace(content, "\r\n", "\n", -1)
+	}
+	return content, format, nil
+}
+
+func decodeLatin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// Runes that cannot be represented in Latin-1 are refused, instead of being
+// silently replaced.
+func encodeContent(content string, format fileFormat) ([]byte, error) {
+	if format.crlf {
+		content = strings.Replace(content, "\n", "\r\n", -1)
+	}
+	var data []byte
+	if format.bom {
+		data = append(data, utf8Bom...)
+	}
+	if !format.latin1 {
+		return append(data, content...), nil
+	}
+	for _, r := range content {
+		if r > 0xFF {
+			return nil, errors.New("content contains characters that cannot be saved as Latin-1")
+		}
+		data = append(data, byte(r))
+	}
+	return data, nil
+}
+
+// Pages of partially loaded files are shrunk to complete runes, bytes left
+// out are still shown by overlapping neighbour pages, and are kept by Put
+// since only the loaded range is replaced. A trailing "\r" is also left out,
+// so CRLF conversion never splits a line ending.
+func alignPage(data []byte, start int64, atEnd bool) ([]byte, int64) {
+	lead, end := 0, len(data)
+	for lead < utf8.UTFMax-1 && lead < end && !utf8.RuneStart(data[lead]) {
+		lead++
+	}
+	if !atEnd {
+		for i := end - 1; i >= lead && i >= end-utf8.UTFMax; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:end]) {
+					end = i
+				}
+				break
+			}
+		}
+	}
+	if !utf8.Valid(data[lead:end]) {
+		// Latin-1 content has no multi-byte runes to align
+		lead, end = 0, len(data)
+	}
+	if !atEnd && end > lead && data[end-1] == '\r' {
+		end--
+	}
+	return data[lead:end], start + int64(lead)
+}
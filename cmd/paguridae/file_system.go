@@ -27,6 +27,7 @@ const (
 	Q_ROOT_CONS      = 0x1
 	Q_ROOT_INDEX     = 0x2
 	Q_ROOT_NEW       = 0x3
+	Q_ROOT_SNARF     = 0x4
 	Q_FILE_ADDR      = 0x1
 	Q_FILE_BODY      = 0x2
 	Q_FILE_CTL       = 0x3
@@ -67,6 +68,11 @@ var fileinfos = map[uint32]fileinfo{
 		Type: plan9.QTDIR,
 		Perm: 0500 | plan9.DMDIR,
 	},
+	(PATH_TYPE_ROOT | (Q_ROOT_SNARF << 8)): {
+		Name: "snarf",
+		Type: plan9.QTFILE,
+		Perm: 0600,
+	},
 	(PATH_TYPE_FILE | (Q_DIR << 8)): {
 		Name: ".",
 		Type: plan9.QTDIR,
@@ -332,6 +338,8 @@ func loop(s *Session, conn net.Conn, currentUser *user.User) {
 					switch qType {
 					case Q_ROOT_CONS:
 						fillRreadData(data, *fcall, &response)
+					case Q_ROOT_SNARF:
+						fillRreadData([]byte(s.Snarf()), *fcall, &response)
 					case Q_ROOT_INDEX:
 						files := &otFiles{}
 						for _, change := range s.Server.AllContents() {
@@ -352,7 +360,7 @@ func loop(s *Session, conn net.Conn, currentUser *user.User) {
 								isDirectory = 1
 							}
 							changed := 0
-							if m, _ := regexp.MatchString(`^(?:[^ \n\|]+\s+)?(\|\*)`, labelContent); m {
+							if isDirtyLabel(labelContent) {
 								changed = 1
 							}
 							var firstLine string
@@ -446,6 +454,16 @@ func loop(s *Session, conn net.Conn, currentUser *user.User) {
 			pathType := uint32(qid.Path) & PATH_TYPE_MASK
 			qType := uint8(qid.Path >> 8)
 			if pathType == PATH_TYPE_ROOT {
+				if qType == Q_ROOT_SNARF {
+					// Writing from the start replaces snarf buffer
+					snarf := []byte(s.Snarf())
+					if fcall.Offset > uint64(len(snarf)) {
+						fcall.Offset = uint64(len(snarf))
+					}
+					s.SetSnarf(string(append(snarf[:fcall.Offset], fcall.Data...)))
+					response.Count = uint32(len(fcall.Data))
+					response.Type = plan9.Rwrite
+				}
 				if qType == Q_ROOT_CONS {
 					_, err := s.newErrorBuffer(nil).Write(fcall.Data)
 					if err != nil {
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const MaxOpenResults = 200
+
+// Only commonly used .gitignore syntax is supported: comments, negation,
+// directory only patterns, anchored patterns and leading "**/".
+type ignoreRule struct {
+	base     string
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func loadGitignore(storage Storage, dir string, base string) []ignoreRule {
+	file, err := storage.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	rules := make([]ignoreRule, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		line = strings.TrimSuffix(line, "/**")
+		if strings.HasPrefix(line, "**/") {
+			line = line[3:]
+		} else if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		rule.pattern = line
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// Later rules take precedence, like git does.
+func ignored(rules []ignoreRule, rel string, isDir bool) bool {
+	result := false
+	for _, rule := range rules {
+		if (rule.dirOnly && !isDir) || !strings.HasPrefix(rel, rule.base) {
+			continue
+		}
+		target := rel[len(rule.base):]
+		if !rule.anchored {
+			target = path.Base(target)
+		}
+		if matched, _ := path.Match(rule.pattern, target); matched {
+			result = !rule.negate
+		}
+	}
+	return result
+}
+
+// Files are walked from root, skipping .git and everything ignored by
+// .gitignore files found along the way.
+func projectFiles(storage Storage, root string) ([]string, error) {
+	files := make([]string, 0)
+	var walk func(dir string, base string, rules []ignoreRule) error
+	walk = func(dir string, base string, rules []ignoreRule) error {
+		infos, err := storage.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		// Rules of sibling directories must not leak into each other
+		rules = append(rules[:len(rules):len(rules)], loadGitignore(storage, dir, base)...)
+		for _, info := range infos {
+			rel := base + info.Name()
+			if info.IsDir() {
+				if info.Name() != ".git" && !ignored(rules, rel, true) {
+					// Unreadable directories are skipped
+					walk(filepath.Join(dir, info.Name()), rel+"/", rules)
+				}
+			} else if !ignored(rules, rel, false) {
+				files = append(files, rel)
+			}
+		}
+		return nil
+	}
+	return files, walk(root, "", nil)
+}
+
+// Pattern characters must appear in order in the candidate. Consecutive
+// matches, matches at the start of words, and matches in the file name
+// are ranked higher.
+func fuzzyScore(pattern []rune, candidate []rune) (int, bool) {
+	baseStart := 0
+	for i, c := range candidate {
+		if c == '/' {
+			baseStart = i + 1
+		}
+	}
+	score, p, previous := 0, 0, -2
+	for i, c := range candidate {
+		if p == len(pattern) {
+			break
+		}
+		if unicode.ToLower(c) != unicode.ToLower(pattern[p]) {
+			continue
+		}
+		score++
+		if previous == i-1 {
+			score += 5
+		}
+		if i == 0 || strings.ContainsRune("/_-. ", candidate[i-1]) {
+			score += 3
+		}
+		if i >= baseStart {
+			score += 2
+		}
+		previous = i
+		p++
+	}
+	return score, p == len(pattern)
+}
+
+func fuzzyFind(pattern string, files []string) []string {
+	type match struct {
+		file  string
+		score int
+	}
+	matches := make([]match, 0)
+	patternRunes := []rune(pattern)
+	for _, file := range files {
+		if score, ok := fuzzyScore(patternRunes, []rune(file)); ok {
+			matches = append(matches, match{file, score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		if len(matches[i].file) != len(matches[j].file) {
+			return len(matches[i].file) < len(matches[j].file)
+		}
+		return matches[i].file < matches[j].file
+	})
+	if len(matches) > MaxOpenResults {
+		matches = matches[:MaxOpenResults]
+	}
+	results := make([]string, len(matches))
+	for i, m := range matches {
+		results[i] = m.file
+	}
+	return results
+}
+
+// Open searches the window's directory tree. A single match is opened
+// directly, otherwise matches are listed in a +Open window, where each
+// line can be clicked to open the file.
+func (s *Session) openFuzzy(storage Storage, pathInfo fullPathInfo, pattern string) (*Selection, bool, error) {
+	root, err := filepath.Abs(windowDirectory(storage, pathInfo))
+	if err != nil {
+		return nil, false, err
+	}
+	files, err := projectFiles(storage, root)
+	if err != nil {
+		return nil, false, err
+	}
+	results := fuzzyFind(pattern, files)
+	if len(results) == 1 {
+		selection, created, _, err := s.openPath(storage, filepath.Join(root, results[0]))
+		return selection, created, err
+	}
+	content := strings.Join(results, "\n")
+	if len(content) > 0 {
+		content += "\n"
+	}
+	_, err = s.replaceDummyFile(filepath.Join(root, "+Open"), content)
+	return nil, false, err
+}
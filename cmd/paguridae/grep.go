@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const MaxGrepResults = 10000
+
+// Binary files are skipped.
+func grepFile(storage Storage, re *regexp.Regexp, root string, rel string) []string {
+	file, err := storage.Open(filepath.Join(root, rel))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil
+	}
+	if isBinary(data) {
+		return nil
+	}
+	results := make([]string, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if re.MatchString(line) {
+			results = append(results, fmt.Sprintf("%s:%d: %s\n", rel, i+1, line))
+		}
+	}
+	return results
+}
+
+// Grep searches files under the window's directory concurrently, results
+// are streamed into a +Grep window as they are found, in the format of
+// "path:line: text", which opens the file at the line when clicked.
+func (s *Session) grep(storage Storage, pathInfo fullPathInfo, pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.Abs(windowDirectory(storage, pathInfo))
+	if err != nil {
+		return err
+	}
+	files, err := projectFiles(storage, root)
+	if err != nil {
+		return err
+	}
+	contentId, err := s.replaceDummyFile(filepath.Join(root, "+Grep"), "")
+	if err != nil {
+		return err
+	}
+	paths := make(chan string)
+	results := make(chan []string)
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rel := range paths {
+				if lines := grepFile(storage, re, root, rel); len(lines) > 0 {
+					results <- lines
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, file := range files {
+			paths <- file
+		}
+		close(paths)
+		wg.Wait()
+		close(results)
+	}()
+	count := 0
+	for lines := range results {
+		// Remaining results are drained so workers can finish
+		if count >= MaxGrepResults {
+			continue
+		}
+		if count+len(lines) > MaxGrepResults {
+			lines = lines[:MaxGrepResults-count]
+		}
+		count += len(lines)
+		s.Server.Append(contentId, []rune(strings.Join(lines, "")))
+	}
+	if count >= MaxGrepResults {
+		s.Server.Append(contentId, []rune(fmt.Sprintf("Too many results, only the first %d are shown\n", MaxGrepResults)))
+	}
+	return nil
+}
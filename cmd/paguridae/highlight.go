@@ -0,0 +1,279 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+	"xuejie.space/c/paguridae/pkg/ot"
+)
+
+const HighlightDelay = 200 * time.Millisecond
+
+// Highlighting uses Quill's built-in color format, so clients need nothing
+// special to render it. Attributes are never saved, since Put only uses
+// the text of a window.
+var highlightColors = map[string]string{
+	"comment": "#808080",
+	"string":  "#2a7f2a",
+	"keyword": "#7f0055",
+	"number":  "#1c5fa8",
+}
+
+type syntax struct {
+	re      *regexp.Regexp
+	classes []string
+}
+
+// Each rule is a pair of class and pattern, patterns must not contain
+// capturing groups. Earlier rules win when multiple rules match. Tokens
+// spanning lines run to the end of text when unterminated, so rescanning
+// from a line start no token crosses is the same as scanning everything.
+func newSyntax(rules ...[2]string) *syntax {
+	s := &syntax{}
+	patterns := make([]string, len(rules))
+	for i, rule := range rules {
+		s.classes = append(s.classes, rule[0])
+		patterns[i] = "(" + rule[1] + ")"
+	}
+	s.re = regexp.MustCompile("(?m)" + strings.Join(patterns, "|"))
+	return s
+}
+
+var (
+	cStyleComment = [2]string{"comment", `//[^\n]*|/\*[\s\S]*?(?:\*/|\z)`}
+	quotedString  = [2]string{"string", `"(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*'`}
+	number        = [2]string{"number", `\b\d+(?:\.\d+)?\b`}
+
+	syntaxes = map[string]*syntax{
+		".go": newSyntax(
+			cStyleComment,
+			[2]string{"string", `"(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*'|` + "`[^`]*(?:`|\\z)"},
+			[2]string{"keyword", `\b(?:break|case|chan|const|continue|default|defer|else|fallthrough|for|func|go|goto|if|import|interface|map|package|range|return|select|struct|switch|type|var)\b`},
+			number),
+		".js": newSyntax(
+			cStyleComment,
+			[2]string{"string", `"(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*'|` + "`(?:[^`\\\\]|\\\\[\\s\\S]?)*(?:`|\\z)"},
+			[2]string{"keyword", `\b(?:async|await|break|case|catch|class|const|continue|default|delete|do|else|export|extends|finally|for|from|function|if|import|in|instanceof|let|new|of|return|static|super|switch|this|throw|try|typeof|var|void|while|yield)\b`},
+			number),
+		".css": newSyntax(
+			[2]string{"comment", `/\*[\s\S]*?(?:\*/|\z)`},
+			quotedString,
+			[2]string{"keyword", `@[\w-]+|!important`},
+			[2]string{"number", `#[0-9a-fA-F]{3,8}\b|\b\d+(?:\.\d+)?(?:px|em|rem|%|s|ms|vh|vw)?`}),
+		".md": newSyntax(
+			[2]string{"string", "```[\\s\\S]*?(?:```|\\z)|`[^`\\n]*`"},
+			[2]string{"keyword", `^#{1,6} [^\n]*|\*\*[^*\n]+\*\*`},
+			[2]string{"number", `\[[^\]\n]*\]\([^)\n]*\)`}),
+		".sh": newSyntax(
+			[2]string{"comment", `(?:^|[ \t])#[^\n]*`},
+			quotedString,
+			[2]string{"keyword", `\b(?:case|do|done|elif|else|esac|export|fi|for|function|if|in|local|return|then|until|while)\b`},
+			[2]string{"number", `\$\{[^}\n]*\}|\$[\w@#?*!$-]`}),
+	}
+)
+
+func init() {
+	syntaxes[".mjs"] = syntaxes[".js"]
+	syntaxes[".markdown"] = syntaxes[".md"]
+	syntaxes[".bash"] = syntaxes[".sh"]
+}
+
+// Changed part of text since old as byte offsets in text, the whole text
+// is changed when there is no old text. An edit can be aligned to several
+// places when it repeats text around it, the range covers all of them.
+func changedRange(old string, text string) (int, int) {
+	prefix, suffix := commonAffixes(old, text, true)
+	leftPrefix, leftSuffix := commonAffixes(old, text, false)
+	if leftPrefix < prefix {
+		prefix = leftPrefix
+	}
+	if leftSuffix < suffix {
+		suffix = leftSuffix
+	}
+	return prefix, len(text) - suffix
+}
+
+// Lengths of common prefix and suffix, which never overlap, the one found
+// first is the longest possible.
+func commonAffixes(old string, text string, prefixFirst bool) (int, int) {
+	limit := len(old)
+	if len(text) < limit {
+		limit = len(text)
+	}
+	prefix, suffix := 0, 0
+	for i := 0; i < 2; i++ {
+		if prefixFirst == (i == 0) {
+			for prefix < limit-suffix && old[prefix] == text[prefix] {
+				prefix++
+			}
+		} else {
+			for suffix < limit-prefix && old[len(old)-1-suffix] == text[len(text)-1-suffix] {
+				suffix++
+			}
+		}
+	}
+	return prefix, suffix
+}
+
+// Colors of runes rescanned around the changed part [start, end) of text,
+// empty string means no color. Scanning starts from a line start where no
+// token of current colors crosses, and stops at the first such line start
+// after end, since scanning from there yields current colors again. The
+// rune index of the first rescanned rune is also returned.
+func (s *syntax) recolor(text string, current []string, start int, end int) (int, []string) {
+	start = strings.LastIndexByte(text[:start], '\n') + 1
+	runeStart := utf8.RuneCountInString(text[:start])
+	for start > 0 && runeStart <= len(current) && len(current[runeStart-1]) > 0 {
+		lineStart := strings.LastIndexByte(text[:start-1], '\n') + 1
+		runeStart -= utf8.RuneCountInString(text[lineStart:start])
+		start = lineStart
+	}
+	colors := make([]string, 0)
+	pos := start
+	for pos < len(text) {
+		next, nextEnd, color := len(text), len(text), ""
+		if loc := s.re.FindStringSubmatchIndex(text[pos:]); loc != nil && loc[1] > loc[0] {
+			next, nextEnd = pos+loc[0], pos+loc[1]
+			for i := range s.classes {
+				if loc[2*i+2] >= 0 {
+					color = highlightColors[s.classes[i]]
+					break
+				}
+			}
+		}
+		for i, r := range text[pos:next] {
+			colors = append(colors, "")
+			index := runeStart + len(colors) - 1
+			if r == '\n' && pos+i >= end && (index >= len(current) || len(current[index]) == 0) {
+				return runeStart, colors
+			}
+		}
+		for range text[next:nextEnd] {
+			colors = append(colors, color)
+		}
+		pos = nextEnd
+	}
+	return runeStart, colors
+}
+
+// Only ranges whose colors change are included in the returned delta, so
+// highlighting stays incremental for both the OT history and clients. Old
+// is the text highlighted last time.
+func highlightDelta(d delta.Delta, s *syntax, old string) delta.Delta {
+	text := DeltaToString(d, true)
+	current := make([]string, 0, len(text))
+	for _, op := range d.Ops {
+		color, _ := op.Attributes["color"].(string)
+		length := len(op.Insert)
+		if op.InsertEmbed != nil {
+			length = 1
+		}
+		for i := 0; i < length; i++ {
+			current = append(current, color)
+		}
+	}
+	start, end := changedRange(old, text)
+	from, desired := s.recolor(text, current, start, end)
+	result := delta.New(nil)
+	retained := 0
+	for i := 0; i < len(desired) && from+i < len(current); {
+		if desired[i] == current[from+i] {
+			i++
+			continue
+		}
+		j := i
+		for j < len(desired) && from+j < len(current) && desired[j] != current[from+j] && desired[j] == desired[i] {
+			j++
+		}
+		var color interface{}
+		if len(desired[i]) > 0 {
+			color = desired[i]
+		}
+		result.Retain(from+i-retained, nil).Retain(j-i, map[string]interface{}{"color": color})
+		retained = from + j
+		i = j
+	}
+	return *result
+}
+
+func syntaxForLabel(label *ot.ServerUpdate) *syntax {
+	if label == nil {
+		return nil
+	}
+	return syntaxes[filepath.Ext(extractPath(label.Delta).path)]
+}
+
+// Session's own connection receives every update, versions are compared
+// so only changed content files are highlighted again.
+func (s *Session) scheduleHighlight(updates []ot.ServerUpdate) {
+	s.mux.Lock()
+	for _, update := range updates {
+		if update.Id != MetaFileId && update.Id%2 == 0 &&
+			s.highlighted[update.Id] != update.Version {
+			s.highlightQueue[update.Id] = true
+		}
+	}
+	scheduled := len(s.highlightQueue) > 0
+	s.mux.Unlock()
+	if scheduled {
+		select {
+		case s.highlightSignal <- true:
+		default:
+		}
+	}
+}
+
+// Highlighting runs in its own goroutine, since updating files from the
+// event loop would block the OT server.
+func (s *Session) highlightFiles() {
+	for {
+		select {
+		case <-s.watcherSignal:
+			return
+		case <-s.highlightSignal:
+		}
+		time.Sleep(HighlightDelay)
+		s.mux.Lock()
+		pending := s.highlightQueue
+		s.highlightQueue = make(map[uint32]bool)
+		s.mux.Unlock()
+		for contentId := range pending {
+			err := s.highlight(contentId)
+			if err != nil {
+				log.Printf("Error highlighting file %d: %v", contentId, err)
+			}
+		}
+	}
+}
+
+// Highlighting is not recorded for undo, so Undo only reverts edits.
+func (s *Session) highlight(contentId uint32) error {
+	syn := syntaxForLabel(s.Server.Content(contentId - 1))
+	s.mux.Lock()
+	old := s.highlightedTexts[contentId]
+	s.mux.Unlock()
+	var text string
+	if syn != nil {
+		err := s.Server.UpdateUnrecorded(contentId, func(d delta.Delta) (delta.Delta, error) {
+			text = DeltaToString(d, true)
+			return highlightDelta(d, syn, old), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	content := s.Server.Content(contentId)
+	if content == nil {
+		return nil
+	}
+	s.mux.Lock()
+	s.highlighted[contentId] = content.Version
+	s.highlightedTexts[contentId] = text
+	s.mux.Unlock()
+	return nil
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+	"github.com/google/uuid"
+)
+
+// Layout is kept in the meta file, the first line contains widths of all
+// columns, each of the following lines describes one window in the format
+// of "<label id> <column> <height>", windows in the same column are ordered
+// from top to bottom. Widths and heights are all percentages.
+type LayoutRow struct {
+	Id     uint32
+	Height float64
+}
+
+type LayoutColumn struct {
+	Width float64
+	Rows  []LayoutRow
+}
+
+type Layout struct {
+	Columns []LayoutColumn
+}
+
+type clientLayout struct {
+	layout  *Layout
+	version uint32
+}
+
+func NewLayout() *Layout {
+	return &Layout{
+		Columns: []LayoutColumn{
+			{Width: 50},
+			{Width: 50},
+		},
+	}
+}
+
+func ParseLayout(content string) (*Layout, error) {
+	layout := &Layout{}
+	for _, line := range strings.Split(content, "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		fields := strings.Fields(line)
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid layout line: %s", line)
+		}
+		if id == MetaFileId {
+			for _, field := range fields[1:] {
+				width, err := strconv.ParseFloat(field, 64)
+				if err != nil {
+					return nil, fmt.Errorf("Invalid column width: %s", field)
+				}
+				layout.Columns = append(layout.Columns, LayoutColumn{Width: width})
+			}
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Invalid layout line: %s", line)
+		}
+		column, err := strconv.Atoi(fields[1])
+		if err != nil || column < 0 || column >= len(layout.Columns) {
+			return nil, fmt.Errorf("Invalid column in layout line: %s", line)
+		}
+		height, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid height in layout line: %s", line)
+		}
+		layout.Columns[column].Rows = append(layout.Columns[column].Rows, LayoutRow{
+			Id:     uint32(id),
+			Height: height,
+		})
+	}
+	if len(layout.Columns) == 0 {
+		return NewLayout(), nil
+	}
+	return layout, nil
+}
+
+func formatPercentage(f float64) string {
+	return strconv.FormatFloat(math.Round(f*100)/100, 'f', -1, 64)
+}
+
+func (l *Layout) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d", MetaFileId)
+	for _, column := range l.Columns {
+		fmt.Fprintf(&b, " %s", formatPercentage(column.Width))
+	}
+	b.WriteString("\n")
+	for i, column := range l.Columns {
+		for _, row := range column.Rows {
+			fmt.Fprintf(&b, "%d %d %s\n", row.Id, i, formatPercentage(row.Height))
+		}
+	}
+	return b.String()
+}
+
+func (l *Layout) Delta() delta.Delta {
+	return *delta.New(nil).Insert(l.String(), nil)
+}
+
+func (l *Layout) Ids() []uint32 {
+	ids := make([]uint32, 0)
+	for _, column := range l.Columns {
+		for _, row := range column.Rows {
+			ids = append(ids, row.Id)
+		}
+	}
+	return ids
+}
+
+// Sync removes windows that no longer exist, and places new windows, it
+// returns true when layout is changed.
+func (l *Layout) Sync(ids []uint32) bool {
+	existing := make(map[uint32]bool)
+	for _, id := range ids {
+		existing[id] = true
+	}
+	changed := false
+	for _, id := range l.Ids() {
+		if existing[id] {
+			delete(existing, id)
+		} else {
+			l.DeleteRow(id)
+			changed = true
+		}
+	}
+	newIds := make([]uint32, 0, len(existing))
+	for id := range existing {
+		newIds = append(newIds, id)
+	}
+	sort.Slice(newIds, func(i, j int) bool { return newIds[i] < newIds[j] })
+	for _, id := range newIds {
+		l.CreateRow(id)
+		changed = true
+	}
+	return changed
+}
+
+// New windows are placed at the bottom of the column with the most spare
+// space, taking half of the height of the last window in that column.
+func (l *Layout) CreateRow(id uint32) {
+	columnIndex := -1
+	columnSpareHeight := float64(0)
+	for i, column := range l.Columns {
+		currentHeight := float64(100)
+		if len(column.Rows) > 0 {
+			currentHeight = column.Rows[len(column.Rows)-1].Height / 2
+		}
+		if currentHeight > columnSpareHeight {
+			columnIndex = i
+			columnSpareHeight = currentHeight
+		}
+	}
+	if columnIndex == -1 {
+		return
+	}
+	column := &l.Columns[columnIndex]
+	if len(column.Rows) > 0 {
+		column.Rows[len(column.Rows)-1].Height -= columnSpareHeight
+	}
+	column.Rows = append(column.Rows, LayoutRow{
+		Id:     id,
+		Height: columnSpareHeight,
+	})
+}
+
+func (l *Layout) DeleteRow(id uint32) {
+	for c := range l.Columns {
+		column := &l.Columns[c]
+		for i, row := range column.Rows {
+			if row.Id == id {
+				growIndex := i - 1
+				if i == 0 {
+					growIndex = i + 1
+				}
+				if growIndex < len(column.Rows) {
+					column.Rows[growIndex].Height += row.Height
+				}
+				column.Rows = append(column.Rows[:i], column.Rows[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (l *Layout) CreateColumn() {
+	last := &l.Columns[len(l.Columns)-1]
+	width := last.Width / 2
+	last.Width -= width
+	l.Columns = append(l.Columns, LayoutColumn{Width: width})
+}
+
+// RemoveColumn removes the column containing the specified window, windows
+// in the removed column are placed again in remaining columns.
+func (l *Layout) RemoveColumn(id uint32) {
+	if len(l.Columns) == 1 {
+		return
+	}
+	column, _, ok := l.locateById(id)
+	if !ok {
+		return
+	}
+	removed := l.Columns[column]
+	l.Columns = append(l.Columns[:column], l.Columns[column+1:]...)
+	l.Columns[len(l.Columns)-1].Width += removed.Width
+	for _, row := range removed.Rows {
+		l.CreateRow(row.Id)
+	}
+}
+
+func (l *Layout) locateById(id uint32) (int, int, bool) {
+	for c, column := range l.Columns {
+		for r, row := range column.Rows {
+			if row.Id == id {
+				return c, r, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// Row would be -1 if y is below all windows in the located column.
+func (l *Layout) locateByPosition(x float64, y float64) (column int, row int, xPosition float64, position float64, ok bool) {
+	column, row = -1, -1
+	currentWidth := float64(0)
+	for i, c := range l.Columns {
+		if x < currentWidth+c.Width {
+			column = i
+			break
+		}
+		currentWidth += c.Width
+	}
+	if column == -1 {
+		return
+	}
+	currentHeight := float64(0)
+	for i, r := range l.Columns[column].Rows {
+		if y < currentHeight+r.Height {
+			row = i
+			break
+		}
+		currentHeight += r.Height
+	}
+	return column, row, x - currentWidth, y - currentHeight, true
+}
+
+// Move handles a window dropped at position(x, y), both are percentages of
+// the whole screen. Depending on the position, it either resizes columns or
+// windows, or moves the window to a new place.
+func (l *Layout) Move(id uint32, x float64, y float64) {
+	sourceColumn, sourceRow, ok := l.locateById(id)
+	if !ok {
+		return
+	}
+	column, row, xPosition, position, ok := l.locateByPosition(x, y)
+	if !ok {
+		return
+	}
+	columns := l.Columns
+	if sourceRow == 0 && row == 0 && sourceColumn == column && position < 5 {
+		// Shrinking column
+		if column > 0 {
+			columns[column-1].Width += xPosition
+			columns[column].Width -= xPosition
+		}
+	} else if sourceRow == 0 && row == 0 && sourceColumn == column+1 && position < 5 {
+		// Enlarging column
+		diff := columns[column].Width - xPosition
+		columns[column].Width -= diff
+		columns[sourceColumn].Width += diff
+	} else if sourceColumn == column && sourceRow == row {
+		// Shrinking row
+		if row > 0 {
+			columns[column].Rows[row-1].Height += position
+			columns[column].Rows[row].Height -= position
+		}
+	} else if sourceColumn == column && sourceRow == row+1 {
+		// Enlarging row
+		diff := columns[column].Rows[row].Height - position
+		columns[column].Rows[row].Height -= diff
+		columns[sourceColumn].Rows[sourceRow].Height += diff
+	} else if row == -1 {
+		// Moving row to an empty column
+		l.DeleteRow(id)
+		l.Columns[column].Rows = append([]LayoutRow{{Id: id, Height: 100}}, l.Columns[column].Rows...)
+	} else {
+		// Moving row to a new location
+		targetId := columns[column].Rows[row].Id
+		l.DeleteRow(id)
+		rows := l.Columns[column].Rows
+		for i := range rows {
+			if rows[i].Id == targetId {
+				remaining := rows[i].Height - position
+				rows[i].Height = position
+				rows = append(rows[:i+1], append([]LayoutRow{{Id: id, Height: remaining}}, rows[i+1:]...)...)
+				break
+			}
+		}
+		l.Columns[column].Rows = rows
+	}
+}
+
+func (s *Session) sharedLayout() (*Layout, error) {
+	content := s.Server.Content(MetaFileId)
+	if content == nil {
+		return nil, fmt.Errorf("Metafile does not exist, something is seriously wrong!")
+	}
+	return ParseLayout(DeltaToString(content.Delta, true))
+}
+
+func (s *Session) clientLayout(clientId uuid.UUID) (*clientLayout, error) {
+	s.mux.Lock()
+	l := s.clientLayouts[clientId]
+	s.mux.Unlock()
+	if l != nil {
+		return l, nil
+	}
+	// Per-client layout starts from the shared one kept in meta file
+	shared, err := s.sharedLayout()
+	if err != nil {
+		return nil, err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if l = s.clientLayouts[clientId]; l == nil {
+		l = &clientLayout{
+			layout:  shared,
+			version: 1,
+		}
+		s.clientLayouts[clientId] = l
+	}
+	return l, nil
+}
+
+// ClientLayout returns the per-client layout when it differs from the
+// specified version. Empty string is returned when per-client layout is
+// not enabled, where clients should use the meta file directly.
+func (s *Session) ClientLayout(clientId uuid.UUID, version uint32) (string, uint32) {
+	if !s.perClientLayout {
+		return "", version
+	}
+	l, err := s.clientLayout(clientId)
+	if err != nil {
+		log.Printf("Error locating client layout: %v", err)
+		return "", version
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if l.version == version {
+		return "", version
+	}
+	return l.layout.String(), l.version
+}
+
+func (s *Session) updateLayout(clientId uuid.UUID, f func(l *Layout)) error {
+	if s.perClientLayout {
+		l, err := s.clientLayout(clientId)
+		if err != nil {
+			return err
+		}
+		s.mux.Lock()
+		f(l.layout)
+		l.version++
+		s.mux.Unlock()
+		return nil
+	}
+	return s.Server.Update(MetaFileId, func(d delta.Delta) (delta.Delta, error) {
+		layout, err := ParseLayout(DeltaToString(d, true))
+		if err != nil {
+			return *delta.New(nil), err
+		}
+		f(layout)
+		return *Diff(d, layout.Delta()), nil
+	})
+}
+
+func (s *Session) MoveWindow(clientId uuid.UUID, move Move) error {
+	labelId := move.Id - 1 + move.Id%2
+	return s.updateLayout(clientId, func(l *Layout) {
+		l.Move(labelId, move.X, move.Y)
+	})
+}
+
+// Scrolling paged windows might load more pages.
+func (s *Session) UpdateSizes(sizes []Size) {
+	s.mux.Lock()
+	scrolled := make([]Size, 0)
+	for _, size := range sizes {
+		if size.Id%2 == 0 && size.Top != s.sizes[size.Id].Top {
+			scrolled = append(scrolled, size)
+		}
+		s.sizes[size.Id] = size
+	}
+	s.mux.Unlock()
+
+	for _, size := range scrolled {
+		s.schedulePaging(size.Id, size.Top)
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+)
+
+var lspServers map[string][]string
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+// Both Location and LocationLink are decoded into this struct.
+type lspLocation struct {
+	URI         string   `json:"uri"`
+	Range       lspRange `json:"range"`
+	TargetURI   string   `json:"targetUri"`
+	TargetRange lspRange `json:"targetSelectionRange"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      *int            `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type lspClient struct {
+	root        string
+	stdin       io.Writer
+	nextId      int
+	pending     map[int]chan lspMessage
+	versions    map[string]int
+	diagnostics map[string]string
+	// Closed once the server is initialized, or failed with startErr.
+	started  chan bool
+	startErr error
+	mux      sync.Mutex
+	writeMux sync.Mutex
+}
+
+func fileURI(path string) string {
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+func uriPath(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	return u.Path
+}
+
+// LSP positions count UTF-16 code units.
+func runesToPosition(text []rune, offset int) lspPosition {
+	var p lspPosition
+	for i := 0; i < offset && i < len(text); i++ {
+		if text[i] == '\n' {
+			p.Line++
+			p.Character = 0
+		} else if text[i] >= 0x10000 {
+			p.Character += 2
+		} else {
+			p.Character++
+		}
+	}
+	return p
+}
+
+func positionToRunes(text []rune, p lspPosition) int {
+	i := 0
+	for line := 0; i < len(text) && line < p.Line; i++ {
+		if text[i] == '\n' {
+			line++
+		}
+	}
+	for character := 0; i < len(text) && text[i] != '\n' && character < p.Character; i++ {
+		character++
+		if text[i] >= 0x10000 {
+			character++
+		}
+	}
+	return i
+}
+
+// Project root is the closest directory containing go.mod, package.json
+// or .git.
+func projectRoot(storage Storage, path string) string {
+	dir := filepath.Dir(path)
+	for d := dir; ; d = filepath.Dir(d) {
+		for _, marker := range []string{"go.mod", "package.json", ".git"} {
+			if _, err := storage.Stat(filepath.Join(d, marker)); err == nil {
+				return d
+			}
+		}
+		if d == filepath.Dir(d) {
+			return dir
+		}
+	}
+}
+
+func (c *lspClient) write(message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	c.writeMux.Lock()
+	defer c.writeMux.Unlock()
+	_, err = fmt.Fprintf(c.stdin, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+func (c *lspClient) notify(method string, params interface{}) error {
+	return c.write(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+		"params":  params,
+	})
+}
+
+func (c *lspClient) call(method string, params interface{}, result interface{}) error {
+	c.mux.Lock()
+	c.nextId++
+	id := c.nextId
+	responseChan := make(chan lspMessage, 1)
+	c.pending[id] = responseChan
+	c.mux.Unlock()
+	defer func() {
+		c.mux.Lock()
+		delete(c.pending, id)
+		c.mux.Unlock()
+	}()
+	err := c.write(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case response, ok := <-responseChan:
+		if !ok {
+			return errors.New("Language server exited")
+		}
+		if response.Error != nil {
+			return fmt.Errorf("%s: %s", method, response.Error.Message)
+		}
+		if result == nil || len(response.Result) == 0 {
+			return nil
+		}
+		return json.Unmarshal(response.Result, result)
+	case <-time.After(CommandTimeoutSeconds * time.Second):
+		return fmt.Errorf("%s timed out", method)
+	}
+}
+
+func (c *lspClient) read(s *Session, stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		length := 0
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				c.close()
+				return
+			}
+			line = strings.TrimSpace(line)
+			if len(line) == 0 {
+				break
+			}
+			if strings.HasPrefix(line, "Content-Length:") {
+				length, _ = strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "Content-Length:")))
+			}
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			c.close()
+			return
+		}
+		var message lspMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			log.Printf("Error parsing language server message: %v", err)
+			continue
+		}
+		switch {
+		case message.Id != nil && len(message.Method) > 0:
+			c.respond(message)
+		case message.Id != nil:
+			c.mux.Lock()
+			if responseChan, ok := c.pending[*message.Id]; ok {
+				responseChan <- message
+			}
+			c.mux.Unlock()
+		case message.Method == "textDocument/publishDiagnostics":
+			c.publishDiagnostics(s, message.Params)
+		}
+	}
+}
+
+// Requests from servers are answered with empty results, except for
+// configurations, which must be an array matching requested items.
+func (c *lspClient) respond(request lspMessage) {
+	var result interface{}
+	if request.Method == "workspace/configuration" {
+		var params struct {
+			Items []interface{} `json:"items"`
+		}
+		json.Unmarshal(request.Params, &params)
+		result = make([]interface{}, len(params.Items))
+	}
+	c.write(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      *request.Id,
+		"result":  result,
+	})
+}
+
+func (c *lspClient) close() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for id, responseChan := range c.pending {
+		close(responseChan)
+		delete(c.pending, id)
+	}
+}
+
+// Diagnostics are written to +Errors as "path:line:column: message", so
+// they open at the right place when clicked.
+func (c *lspClient) publishDiagnostics(s *Session, params json.RawMessage) {
+	var diagnostics struct {
+		URI         string `json:"uri"`
+		Diagnostics []struct {
+			Range   lspRange `json:"range"`
+			Message string   `json:"message"`
+		} `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(params, &diagnostics); err != nil {
+		return
+	}
+	var b strings.Builder
+	path := uriPath(diagnostics.URI)
+	for _, d := range diagnostics.Diagnostics {
+		fmt.Fprintf(&b, "%s:%d:%d: %s\n", path, d.Range.Start.Line+1, d.Range.Start.Character+1, d.Message)
+	}
+	c.mux.Lock()
+	changed := c.diagnostics[diagnostics.URI] != b.String()
+	c.diagnostics[diagnostics.URI] = b.String()
+	c.mux.Unlock()
+	if changed && b.Len() > 0 {
+		w := &errorsBufferWriter{path: c.root, s: s}
+		w.Write([]byte(b.String()))
+	}
+}
+
+// Documents are synchronized with full content before each request.
+func (c *lspClient) sync(path string, text string) error {
+	uri := fileURI(path)
+	c.mux.Lock()
+	version, opened := c.versions[uri]
+	c.versions[uri] = version + 1
+	c.mux.Unlock()
+	if !opened {
+		return c.notify("textDocument/didOpen", map[string]interface{}{
+			"textDocument": map[string]interface{}{
+				"uri":        uri,
+				"languageId": strings.TrimPrefix(filepath.Ext(path), "."),
+				"version":    version + 1,
+				"text":       text,
+			},
+		})
+	}
+	return c.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": uri, "version": version + 1},
+		"contentChanges": []interface{}{map[string]string{"text": text}},
+	})
+}
+
+// Language servers are started per command and project root, they are
+// tracked as processes, so Ps lists them and Kill stops them. Clients are
+// added before starting, so concurrent requests wait for the same server.
+func (s *Session) lspClientFor(storage Storage, path string) (*lspClient, error) {
+	command, ok := lspServers[filepath.Ext(path)]
+	if !ok {
+		return nil, fmt.Errorf("No language server is configured for %s", path)
+	}
+	root := projectRoot(storage, path)
+	key := strings.Join(command, " ") + "\x00" + root
+	s.mux.Lock()
+	client := s.lspClients[key]
+	if client != nil {
+		s.mux.Unlock()
+		<-client.started
+		return client, client.startErr
+	}
+	client = &lspClient{
+		root:        root,
+		pending:     make(map[int]chan lspMessage),
+		versions:    make(map[string]int),
+		diagnostics: make(map[string]string),
+		started:     make(chan bool),
+	}
+	s.lspClients[key] = client
+	s.mux.Unlock()
+	client.startErr = s.startLspClient(client, command, key)
+	if client.startErr != nil {
+		s.removeLspClient(key, client)
+	}
+	close(client.started)
+	return client, client.startErr
+}
+
+func (s *Session) startLspClient(client *lspClient, command []string, key string) error {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = client.root
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	p, err := s.startProcess(cmd, strings.Join(command, " "), 0)
+	if err != nil {
+		return err
+	}
+	client.stdin = stdin
+	go client.read(s, stdout)
+	go func() {
+		s.waitProcess(cmd, p, false)
+		s.removeLspClient(key, client)
+	}()
+	err = client.call("initialize", map[string]interface{}{
+		"processId":    os.Getpid(),
+		"rootUri":      fileURI(client.root),
+		"capabilities": map[string]interface{}{},
+	}, nil)
+	if err == nil {
+		err = client.notify("initialized", map[string]interface{}{})
+	}
+	if err != nil {
+		s.killProcesses([]string{strconv.Itoa(p.pid)})
+	}
+	return err
+}
+
+// A restarted server might already use the key, only client itself is
+// removed.
+func (s *Session) removeLspClient(key string, client *lspClient) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.lspClients[key] == client {
+		delete(s.lspClients, key)
+	}
+}
+
+// Prepares a request at offset of a window, returning the client and
+// position parameters.
+func (s *Session) lspRequest(contentId uint32, offset int) (*lspClient, map[string]interface{}, error) {
+	label := s.Server.Content(contentId - 1)
+	content := s.Server.Content(contentId)
+	if label == nil || content == nil {
+		return nil, nil, fmt.Errorf("Cannot find window %d", contentId)
+	}
+	pathInfo := extractPath(label.Delta)
+	if len(pathInfo.path) == 0 || pathInfo.partialLoad() {
+		return nil, nil, errors.New("Language servers only work with fully loaded files")
+	}
+	client, err := s.lspClientFor(s.windowStorage(contentId), pathInfo.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	text := DeltaToRunes(content.Delta, true)
+	err = client.sync(pathInfo.path, string(text))
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, map[string]interface{}{
+		"textDocument": map[string]string{"uri": fileURI(pathInfo.path)},
+		"position":     runesToPosition(text, offset),
+	}, nil
+}
+
+// Definition is looked up when right clicked texts are neither plumbed nor
+// paths, last boolean value is false when nothing is found.
+func (s *Session) lspDefinition(action Action) (*Selection, bool, bool) {
+	label := s.Server.Content(action.LabelId())
+	if label == nil || action.Id != action.ContentId() {
+		return nil, false, false
+	}
+	if _, ok := lspServers[filepath.Ext(extractPath(label.Delta).path)]; !ok {
+		return nil, false, false
+	}
+	client, params, err := s.lspRequest(action.ContentId(), int(action.Index))
+	if err != nil {
+		log.Printf("Error preparing definition request: %v", err)
+		return nil, false, false
+	}
+	var raw json.RawMessage
+	err = client.call("textDocument/definition", params, &raw)
+	if err != nil {
+		log.Printf("Error requesting definition: %v", err)
+		return nil, false, false
+	}
+	locations := make([]lspLocation, 1)
+	if json.Unmarshal(raw, &locations) != nil {
+		json.Unmarshal(raw, &locations[0])
+	}
+	if len(locations) == 0 {
+		return nil, false, false
+	}
+	location := locations[0]
+	if len(location.TargetURI) > 0 {
+		location.URI, location.Range = location.TargetURI, location.TargetRange
+	}
+	path := uriPath(location.URI)
+	if len(path) == 0 {
+		return nil, false, false
+	}
+	if path == extractPath(label.Delta).path &&
+		location.Range.Start == params["position"].(lspPosition) {
+		// Already at the definition, fall back to searching
+		return nil, false, false
+	}
+	storage := s.windowStorage(action.ContentId())
+	text, err := s.lspText(storage, path)
+	if err != nil {
+		return nil, false, false
+	}
+	q0, q1 := positionToRunes(text, location.Range.Start), positionToRunes(text, location.Range.End)
+	selection, created, err := s.openFile(storage, parseFullPath(fmt.Sprintf("%s:#%d,#%d", path, q0, q1)))
+	if err != nil {
+		return nil, false, false
+	}
+	return selection, created, true
+}
+
+// Text of a file is taken from its window when opened, or read from storage.
+func (s *Session) lspText(storage Storage, path string) ([]rune, error) {
+	if contentId := s.findWindow(path); contentId != 0 {
+		if content := s.Server.Content(contentId); content != nil {
+			return DeltaToRunes(content.Delta, true), nil
+		}
+	}
+	file, err := storage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	return []rune(string(data)), err
+}
+
+func (s *Session) findWindow(path string) uint32 {
+	for _, change := range s.Server.AllContents() {
+		if change.Id != MetaFileId && change.Id%2 != 0 {
+			pathInfo := extractPath(change.Delta)
+			if pathInfo.path == path && !pathInfo.partialLoad() {
+				return change.Id + 1
+			}
+		}
+	}
+	return 0
+}
+
+func (s *Session) lspHover(action Action, pathInfo fullPathInfo) error {
+	if action.Selection.Id != action.ContentId() {
+		return errors.New("Select a position in the window first")
+	}
+	client, params, err := s.lspRequest(action.ContentId(), int(action.Selection.Range.Index))
+	if err != nil {
+		return err
+	}
+	var hover struct {
+		Contents json.RawMessage `json:"contents"`
+	}
+	err = client.call("textDocument/hover", params, &hover)
+	if err != nil {
+		return err
+	}
+	// Contents might be a string, a markup content, or an array of them
+	var markup struct {
+		Value string `json:"value"`
+	}
+	var text string
+	var texts []json.RawMessage
+	if json.Unmarshal(hover.Contents, &text) != nil {
+		if json.Unmarshal(hover.Contents, &texts) == nil {
+			parts := make([]string, 0, len(texts))
+			for _, t := range texts {
+				var part string
+				if json.Unmarshal(t, &part) != nil && json.Unmarshal(t, &markup) == nil {
+					part = markup.Value
+				}
+				parts = append(parts, part)
+			}
+			text = strings.Join(parts, "\n")
+		} else if json.Unmarshal(hover.Contents, &markup) == nil {
+			text = markup.Value
+		}
+	}
+	_, err = s.replaceDummyFile(filepath.Join(windowDirectory(s.windowStorage(action.ContentId()), pathInfo), "+Hover"), text+"\n")
+	return err
+}
+
+// Rename edits are applied to windows, opening files which are not shown
+// yet, each window gets one single undoable edit.
+func (s *Session) lspRename(action Action, newName string) error {
+	if len(newName) == 0 {
+		return errors.New("Rename requires a new name")
+	}
+	if action.Selection.Id != action.ContentId() {
+		return errors.New("Select a position in the window first")
+	}
+	client, params, err := s.lspRequest(action.ContentId(), int(action.Selection.Range.Index))
+	if err != nil {
+		return err
+	}
+	params["newName"] = newName
+	var edit struct {
+		Changes         map[string][]lspTextEdit `json:"changes"`
+		DocumentChanges []struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			Edits []lspTextEdit `json:"edits"`
+		} `json:"documentChanges"`
+	}
+	err = client.call("textDocument/rename", params, &edit)
+	if err != nil {
+		return err
+	}
+	changes := edit.Changes
+	if changes == nil {
+		changes = make(map[string][]lspTextEdit)
+	}
+	for _, change := range edit.DocumentChanges {
+		changes[change.TextDocument.URI] = append(changes[change.TextDocument.URI], change.Edits...)
+	}
+	for uri, edits := range changes {
+		path := uriPath(uri)
+		contentId := s.findWindow(path)
+		if contentId == 0 {
+			selection, _, err := s.openFile(s.windowStorage(action.ContentId()), parseFullPath(path))
+			if err != nil {
+				return err
+			}
+			contentId = selection.Id
+		}
+		err = s.Server.Update(contentId, func(d delta.Delta) (delta.Delta, error) {
+			return lspEditsDelta(DeltaToRunes(d, true), edits), nil
+		})
+		if err != nil {
+			return err
+		}
+		s.markDirty(contentId)
+	}
+	return nil
+}
+
+func lspEditsDelta(text []rune, edits []lspTextEdit) delta.Delta {
+	sort.Slice(edits, func(i, j int) bool {
+		return positionToRunes(text, edits[i].Range.Start) < positionToRunes(text, edits[j].Range.Start)
+	})
+	result := delta.New(nil)
+	index := 0
+	for _, edit := range edits {
+		start, end := positionToRunes(text, edit.Range.Start), positionToRunes(text, edit.Range.End)
+		if start < index {
+			continue
+		}
+		result.Retain(start-index, nil).Delete(end-start).Insert(edit.NewText, nil)
+		index = end
+	}
+	return *result
+}
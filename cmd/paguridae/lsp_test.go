@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"testing"
+)
+
+// Fake language server on the other side of pipes, messages it receives
+// are sent to received, it answers with handle.
+type fakeLspServer struct {
+	reader   *bufio.Reader
+	writer   *io.PipeWriter
+	received chan lspMessage
+}
+
+func newFakeLspServer(t *testing.T, handle func(server *fakeLspServer, message lspMessage)) (*lspClient, *fakeLspServer) {
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	client := &lspClient{
+		stdin:       clientWriter,
+		pending:     make(map[int]chan lspMessage),
+		versions:    make(map[string]int),
+		diagnostics: make(map[string]string),
+	}
+	server := &fakeLspServer{
+		reader:   bufio.NewReader(serverReader),
+		writer:   serverWriter,
+		received: make(chan lspMessage, 16),
+	}
+	go client.read(nil, clientReader)
+	go func() {
+		for {
+			message, err := server.readMessage()
+			if err != nil {
+				return
+			}
+			server.received <- message
+			handle(server, message)
+		}
+	}()
+	t.Cleanup(func() {
+		serverWriter.Close()
+		clientWriter.Close()
+	})
+	return client, server
+}
+
+func (f *fakeLspServer) readMessage() (lspMessage, error) {
+	var message lspMessage
+	header, err := textproto.NewReader(f.reader).ReadMIMEHeader()
+	if err != nil {
+		return message, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return message, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(f.reader, data); err != nil {
+		return message, err
+	}
+	return message, json.Unmarshal(data, &message)
+}
+
+func (f *fakeLspServer) write(message interface{}) {
+	data, _ := json.Marshal(message)
+	fmt.Fprintf(f.writer, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+func (f *fakeLspServer) reply(id int, result interface{}) {
+	f.write(map[string]interface{}{"jsonrpc": "2.0", "id": id, "result": result})
+}
+
+func TestLspCall(t *testing.T) {
+	client, _ := newFakeLspServer(t, func(server *fakeLspServer, message lspMessage) {
+		if message.Method == "textDocument/definition" {
+			server.reply(*message.Id, []lspLocation{{
+				URI:   fileURI("/tmp/a.go"),
+				Range: lspRange{Start: lspPosition{Line: 1, Character: 2}},
+			}})
+		} else if message.Id != nil {
+			server.write(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      *message.Id,
+				"error":   map[string]string{"message": "unsupported"},
+			})
+		}
+	})
+	var locations []lspLocation
+	err := client.call("textDocument/definition", map[string]string{}, &locations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locations) != 1 || uriPath(locations[0].URI) != "/tmp/a.go" ||
+		locations[0].Range.Start != (lspPosition{Line: 1, Character: 2}) {
+		t.Errorf("Unexpected locations: %+v", locations)
+	}
+	err = client.call("textDocument/hover", map[string]string{}, nil)
+	if err == nil || err.Error() != "textDocument/hover: unsupported" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestLspSync(t *testing.T) {
+	client, server := newFakeLspServer(t, func(*fakeLspServer, lspMessage) {})
+	for i, text := range []string{"package a\n", "package b\n"} {
+		err := client.sync("/tmp/a.go", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := <-server.received
+		var params struct {
+			TextDocument struct {
+				URI        string `json:"uri"`
+				Version    int    `json:"version"`
+				LanguageId string `json:"languageId"`
+				Text       string `json:"text"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		json.Unmarshal(message.Params, &params)
+		if params.TextDocument.Version != i+1 || params.TextDocument.URI != fileURI("/tmp/a.go") {
+			t.Errorf("Unexpected document: %+v", params.TextDocument)
+		}
+		if i == 0 && (message.Method != "textDocument/didOpen" ||
+			params.TextDocument.LanguageId != "go" || params.TextDocument.Text != text) {
+			t.Errorf("Unexpected open: %s %+v", message.Method, params)
+		}
+		if i == 1 && (message.Method != "textDocument/didChange" ||
+			len(params.ContentChanges) != 1 || params.ContentChanges[0].Text != text) {
+			t.Errorf("Unexpected change: %s %+v", message.Method, params)
+		}
+	}
+}
+
+func TestLspServerRequest(t *testing.T) {
+	_, server := newFakeLspServer(t, func(*fakeLspServer, lspMessage) {})
+	server.write(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      7,
+		"method":  "workspace/configuration",
+		"params":  map[string]interface{}{"items": []interface{}{map[string]string{}, map[string]string{}}},
+	})
+	message := <-server.received
+	var result []interface{}
+	json.Unmarshal(message.Result, &result)
+	if message.Id == nil || *message.Id != 7 || len(result) != 2 {
+		t.Errorf("Unexpected response: %+v", message)
+	}
+}
+
+func TestLspServerExit(t *testing.T) {
+	client, _ := newFakeLspServer(t, func(server *fakeLspServer, message lspMessage) {
+		server.writer.Close()
+	})
+	err := client.call("shutdown", nil, nil)
+	if err == nil || err.Error() != "Language server exited" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestLspPositions(t *testing.T) {
+	text := []rune("a😀b\ncd")
+	for offset, position := range []lspPosition{{0, 0}, {0, 1}, {0, 3}, {0, 4}, {1, 0}, {1, 1}} {
+		if p := runesToPosition(text, offset); p != position {
+			t.Errorf("Position of %d is %+v, expected %+v", offset, p, position)
+		}
+		if o := positionToRunes(text, position); o != offset {
+			t.Errorf("Offset of %+v is %d, expected %d", position, o, offset)
+		}
+	}
+}
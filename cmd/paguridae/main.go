@@ -10,8 +10,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"regexp"
+	"strings"
 	"syscall"
 	"time"
 
@@ -32,6 +34,15 @@ var redirectToHttps = flag.Bool("redirectoToHttps", true, "Redirect HTTP request
 var sessionPurgeSeconds = flag.Int("sessionPurgeSeconds", 7200, "Seconds to wait before a session with zero connections is purged.")
 var pageSize = flag.Int("pageSize", 64*1024, "Page size to load in one batch")
 var scrollSize = flag.Int("scrollSize", 60*1024, "Scroll size of each page")
+var directoryPageSize = flag.Int("directoryPageSize", 1000, "Number of entries to list in one page of a directory")
+var watchInterval = flag.Int("watchInterval", 2, "Seconds between checks of opened files for changes on disk, 0 disables watching")
+var loadDump = flag.String("loadDump", "", "Dump file to load into every new session, created by the Dump command")
+var perClientLayout = flag.Bool("perClientLayout", false, "Keep a separate window layout for each client instead of sharing the one in meta file")
+var syntaxHighlight = flag.Bool("syntaxHighlight", true, "Highlight syntax of Go, JS, CSS, Markdown and shell files")
+var shell = flag.String("shell", "sh", "Shell used to run commands, such as sh or rc, commands are passed via -c")
+var lspServersConfig = flag.String("lspServers", "", "Language servers per file extension, such as .go=gopls;.rs=rust-analyzer")
+var formattersConfig = flag.String("formatters", "", "Formatters run on content before Put, such as .go=goimports;.js=prettier --stdin-filepath $paguridae_file")
+var plumbRulesFile = flag.String("plumbRules", "", "File containing plumbing rules for right click search, built-in rules are used when empty")
 
 var sessionManager *SessionManager
 
@@ -197,7 +208,23 @@ func main() {
 		httpSrv.Handler = m.HTTPHandler(httpSrv.Handler)
 	}
 
-	sessionManager = NewSessionManager(*verifyContent, *sessionPurgeSeconds)
+	rules, err := LoadPlumbRules(*plumbRulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plumbRules = rules
+	lspServers = make(map[string][]string)
+	for extension, command := range parseExtensionCommands(*lspServersConfig) {
+		lspServers[extension] = strings.Fields(command)
+	}
+	formatters = parseExtensionCommands(*formattersConfig)
+	for extension, command := range formatters {
+		if _, err := exec.LookPath(strings.Fields(command)[0]); err != nil {
+			log.Printf("Skipping formatter %s for %s: %v", command, extension, err)
+			delete(formatters, extension)
+		}
+	}
+	sessionManager = NewSessionManager(*verifyContent, *perClientLayout, *sessionPurgeSeconds)
 	httpSrv.Addr = fmt.Sprintf(":%d", *port)
 	log.Printf("Starting HTTP server on port: %d", *port)
 	log.Fatal(httpSrv.ListenAndServe())
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+)
+
+// Paged windows show a range of a huge file, labeled as
+// "(start,length,size)path". Instead of opening new windows via Next and
+// Prev, a paged window grows when a client scrolls close to either end of
+// it, clients report the first visible index via Size.Top. Clean windows
+// drop pages far away from the viewport to bound memory usage, while dirty
+// windows keep all loaded pages, so edits across pages are kept until Put.
+const MaxPagedWindowPages = 4
+
+var PageRangeRe = regexp.MustCompile(`^\(\d+,\d+(?:,\d+)?\)`)
+
+// Chunks are decoded with the format detected when the window is loaded,
+// chunks that cannot be stored back the same way are refused.
+func decodeChunk(data []byte, format fileFormat) (string, error) {
+	if isBinary(data) {
+		return "", errors.New("binary content cannot be loaded")
+	}
+	var content string
+	if format.latin1 {
+		content = decodeLatin1(data)
+	} else if utf8.Valid(data) {
+		content = string(data)
+	} else {
+		return "", errors.New("invalid UTF-8 content in the middle of the file")
+	}
+	if format.crlf {
+		if strings.Count(content, "\n") != strings.Count(content, "\r\n") || strings.HasSuffix(content, "\r") {
+			return "", errors.New("line endings change in the middle of the file")
+		}
+		content = strings.Replace(content, "\r\n", "\n", -1)
+	}
+	return content, nil
+}
+
+func readRange(storage Storage, path string, start int64, length int64) ([]byte, error) {
+	file, err := storage.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, start)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// Page range is updated in labels of all views sharing the content.
+func (s *Session) setPageRange(labelId uint32, start int64, length int64, size int64) error {
+	pageRange := fmt.Sprintf("(%d,%d,%d)", start, length, size)
+	views := s.Server.Aliases(labelId + 1)
+	if len(views) == 0 {
+		views = []uint32{labelId + 1}
+	}
+	for _, contentId := range views {
+		err := s.Server.UpdateUnrecorded(contentId-1, func(d delta.Delta) (delta.Delta, error) {
+			text := DeltaToString(d, false)
+			loc := PageRangeRe.FindStringIndex(text)
+			if loc == nil || text[:loc[1]] == pageRange {
+				return *delta.New(nil), nil
+			}
+			return *delta.New(nil).Delete(utf8.RuneCountInString(text[:loc[1]])).Insert(pageRange, nil), nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clean paged window of path in storage, 0 when there is none.
+func (s *Session) pagedWindow(storage Storage, path string) uint32 {
+	for _, change := range s.Server.AllContents() {
+		if change.Id != MetaFileId && change.Id%2 != 0 {
+			pathInfo := extractPath(change.Delta)
+			if pathInfo.path == path && pathInfo.partialLoad() &&
+				!isDirtyLabel(DeltaToString(change.Delta, false)) &&
+				s.windowStorage(change.Id+1) == storage {
+				return change.Id + 1
+			}
+		}
+	}
+	return 0
+}
+
+// Move a clean paged window to another page of the file, like paging it is
+// not recorded for undo.
+func (s *Session) movePage(contentId uint32, pathInfo fullPathInfo, size int64, content string, format fileFormat) error {
+	err := s.setPageRange(contentId-1, *pathInfo.start, *pathInfo.length, size)
+	if err != nil {
+		return err
+	}
+	err = s.Server.UpdateUnrecorded(contentId, func(d delta.Delta) (delta.Delta, error) {
+		return *delta.New(nil).Delete(len(DeltaToRunes(d, true))).Insert(content, nil), nil
+	})
+	if err != nil {
+		return err
+	}
+	s.recordDiskState(contentId, pathInfo, content, format)
+	return nil
+}
+
+func (s *Session) schedulePaging(contentId uint32, top uint32) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.paging[contentId] {
+		return
+	}
+	s.paging[contentId] = true
+	go func() {
+		err := s.pageWindow(contentId, int(top))
+		if err != nil {
+			label := contentId - 1
+			fmt.Fprintf(s.newErrorBuffer(&label), "Error paging window: %v\n", err)
+		}
+		s.mux.Lock()
+		delete(s.paging, contentId)
+		s.mux.Unlock()
+	}()
+}
+
+func (s *Session) pageWindow(contentId uint32, top int) error {
+	defer s.lockBuffer(contentId)()
+	label := s.Server.Content(contentId - 1)
+	content := s.Server.Content(contentId)
+	if label == nil || content == nil {
+		return nil
+	}
+	pathInfo := extractPath(label.Delta)
+	state, ok := s.loadedDiskState(contentId)
+	storage := s.windowStorage(contentId)
+	if !ok || !pathInfo.partialLoad() || isDirectory(storage, pathInfo.path) {
+		return nil
+	}
+	stat, err := storage.Stat(pathInfo.path)
+	if err != nil {
+		return err
+	}
+	page := int64(*pageSize)
+	start, end := *pathInfo.start, *pathInfo.start+*pathInfo.length
+	remaining := len(DeltaToRunes(content.Delta, true)) - top
+	var data []byte
+	forward := int64(remaining) < page/2 && end < stat.Size()
+	if forward {
+		data, err = readRange(storage, pathInfo.path, end, page)
+		if err != nil {
+			return err
+		}
+		data, _ = alignPage(data, end, end+int64(len(data)) >= stat.Size())
+		end += int64(len(data))
+	} else if int64(top) < page/2 && start > 0 {
+		from := start - page
+		if from < 0 {
+			from = 0
+		}
+		data, err = readRange(storage, pathInfo.path, from, start-from)
+		if err != nil {
+			return err
+		}
+		data, start = alignPage(data, from, true)
+	} else {
+		return nil
+	}
+	chunk, err := decodeChunk(data, state.format)
+	if err != nil {
+		return err
+	}
+	dirty := isDirtyLabel(DeltaToString(label.Delta, false))
+	// Paging is not recorded for undo, and the drop is decided on live
+	// content, since edits might arrive after the label is checked.
+	err = s.Server.UpdateUnrecorded(contentId, func(d delta.Delta) (delta.Delta, error) {
+		load := delta.New(nil).Insert(chunk, nil)
+		live := chunk + DeltaToString(d, false)
+		if forward {
+			load = delta.New(nil).Retain(len(DeltaToRunes(d, true)), nil).Insert(chunk, nil)
+			live = DeltaToString(d, false) + chunk
+			state.content += chunk
+		} else {
+			state.content = chunk + state.content
+		}
+		if dirty || live != state.content ||
+			end-start <= MaxPagedWindowPages*page || int64(len(state.content)) <= 2*page {
+			return *load, nil
+		}
+		// Drop a page from the other end, cutting at a line boundary
+		text := state.content
+		var cut int
+		if forward {
+			cut = strings.IndexByte(text[page:], '\n') + int(page) + 1
+			if cut <= int(page) {
+				return *load, nil
+			}
+		} else {
+			cut = strings.LastIndexByte(text[:len(text)-int(page)], '\n') + 1
+			if cut == 0 {
+				return *load, nil
+			}
+		}
+		kept, dropped := text[cut:], text[:cut]
+		if !forward {
+			kept, dropped = text[:cut], text[cut:]
+		}
+		// BOM only exists when the window starts at the beginning
+		droppedFormat := state.format
+		droppedFormat.bom = droppedFormat.bom && forward
+		droppedData, err := encodeContent(dropped, droppedFormat)
+		if err != nil {
+			return delta.Delta{}, err
+		}
+		droppedRunes := utf8.RuneCountInString(dropped)
+		drop := delta.New(nil).Delete(droppedRunes)
+		if forward {
+			start += int64(len(droppedData))
+		} else {
+			drop = delta.New(nil).Retain(utf8.RuneCountInString(kept), nil).Delete(droppedRunes)
+			end -= int64(len(droppedData))
+		}
+		state.content = kept
+		state.format.bom = state.format.bom && !forward
+		return *load.Compose(*drop), nil
+	})
+	if err != nil {
+		return err
+	}
+	pathInfo.start, pathInfo.length = &start, new(int64)
+	*pathInfo.length = end - start
+	err = s.setPageRange(contentId-1, start, end-start, stat.Size())
+	if err != nil {
+		return err
+	}
+	s.recordDiskState(contentId, pathInfo, state.content, state.format)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Plumbing rules are modeled after Plan 9's plumber. Each rule has a
+// "match" line containing a regular expression, followed by an action line,
+// rules are tried in order against the clicked text. Submatches can be
+// referred to as $0, $1, etc. in action templates. Actions are:
+//
+//	open <path:address>  opens the file at address, the rule is skipped when
+//	                     the file does not exist
+//	new <command>        runs a shell command, showing its output in a new
+//	                     window
+//	run <command>        runs a shell command, output goes to +Errors
+//
+// When no rule matches, clicked text is opened as a path if it exists, or
+// searched in current window.
+const DefaultPlumbRules = `# Go compiler and vet output, such as pkg/x.go:42:7:
+match ^([^:\s]+):(\d+):(\d+):?$
+open $1:$2-#0+#$3-#1
+
+# grep -n output and Go stack traces, such as x.go:42:
+match ^([^:\s]+):(\d+):$
+open $1:$2
+
+# Java style stack traces, such as at a.b.C.run(C.java:42)
+match \(([^():\s]+):(\d+)\)$
+open $1:$2
+
+# Manual pages, such as ls(1)
+match ^([a-zA-Z0-9_.\-]+)\((\d)\)$
+new man $2 $1 | col -b
+`
+
+type PlumbRule struct {
+	match    *regexp.Regexp
+	action   string
+	template string
+}
+
+var plumbRules []PlumbRule
+
+func ParsePlumbRules(content string) ([]PlumbRule, error) {
+	rules := make([]PlumbRule, 0)
+	var match *regexp.Regexp
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid plumbing rule line: %s", line)
+		}
+		switch parts[0] {
+		case "match":
+			re, err := regexp.Compile(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			match = re
+		case "open", "new", "run":
+			if match == nil {
+				return nil, fmt.Errorf("Plumbing action without match: %s", line)
+			}
+			rules = append(rules, PlumbRule{
+				match:    match,
+				action:   parts[0],
+				template: parts[1],
+			})
+			match = nil
+		default:
+			return nil, fmt.Errorf("Unknown plumbing rule: %s", line)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// Default rules are used when file is empty.
+func LoadPlumbRules(file string) ([]PlumbRule, error) {
+	if len(file) == 0 {
+		return ParsePlumbRules(DefaultPlumbRules)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePlumbRules(string(content))
+}
+
+// Relative paths are resolved from current window's directory.
+func resolvePath(labelPath string, text string) string {
+	if AbsolutePathRe.MatchString(text) {
+		return text
+	}
+	fullPath := labelPath
+	if !strings.HasSuffix(fullPath, "/") {
+		fullPath += "/../"
+	}
+	return fullPath + text
+}
+
+// Last boolean value is false when the path does not exist.
+func (s *Session) openPath(storage Storage, fullPath string) (*Selection, bool, bool, error) {
+	pathInfo := parseFullPath(fullPath)
+	stat, err := storage.Stat(pathInfo.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, false, nil
+		}
+		return nil, false, true, err
+	}
+	if stat.IsDir() {
+		options, _ := parseListingOptions(nil)
+		return nil, false, true, s.createListing(storage, pathInfo, options)
+	}
+	selection, created, err := s.openFile(storage, pathInfo)
+	return selection, created, true, err
+}
+
+// Last boolean value is false when no rule handles the text.
+func (s *Session) plumb(action Action, labelPath string) (*Selection, bool, bool, error) {
+	text := action.Command
+	for _, rule := range plumbRules {
+		submatches := rule.match.FindStringSubmatchIndex(text)
+		if submatches == nil {
+			continue
+		}
+		expanded := string(rule.match.ExpandString(nil, rule.template, text, submatches))
+		switch rule.action {
+		case "open":
+			selection, created, ok, err := s.openPath(s.windowStorage(action.ContentId()), resolvePath(labelPath, expanded))
+			if ok {
+				return selection, created, true, err
+			}
+		case "new", "run":
+			return nil, false, true, s.plumbCommand(action, labelPath, expanded, rule.action == "new")
+		}
+	}
+	return nil, false, false, nil
+}
+
+func (s *Session) plumbCommand(action Action, labelPath string, command string, newWindow bool) error {
+	dir := windowDirectory(s.windowStorage(action.ContentId()), parseFullPath(labelPath))
+	ctx, cancelCmd := context.WithTimeout(context.Background(), CommandTimeoutSeconds*time.Second)
+	defer cancelCmd()
+	cmd := exec.Command(*shell, "-c", command)
+	cmd.Dir = dir
+	labelId := action.LabelId()
+	w := s.newErrorBuffer(&labelId)
+	cmd.Stderr = w
+	var stdoutBuffer bytes.Buffer
+	if newWindow {
+		cmd.Stdout = &stdoutBuffer
+	} else {
+		cmd.Stdout = w
+	}
+	err := s.runProcess(ctx, cmd, action.Command, labelId, false)
+	if err != nil || !newWindow {
+		return err
+	}
+	content := stdoutBuffer.String()
+	label := fmt.Sprintf("%s%s", filepath.Join(dir, "+"+action.Command), DefaultLabel)
+	_, err = s.createFile(label, &content)
+	return err
+}
@@ -0,0 +1,26 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Without process groups, only the started process itself is stopped.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func setSessionLeader(cmd *exec.Cmd) {}
+
+func killProcessGroup(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
+
+func hangupProcessGroup(pid int) error {
+	return killProcessGroup(pid)
+}
@@ -0,0 +1,29 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// Commands are started in their own process groups, so killing the group
+// also stops child processes, such as test binaries started by go test.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// Process groups are created by Setsid, a shell session leader is also the
+// leader of its process group.
+func setSessionLeader(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+}
+
+func killProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+func hangupProcessGroup(pid int) error {
+	return syscall.Kill(-pid, syscall.SIGHUP)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type process struct {
+	pid       int
+	name      string
+	labelId   uint32
+	startedAt time.Time
+}
+
+// Non-zero exit statuses are always reported in +Errors, while successful
+// exits are only reported when reportExit is set.
+func (s *Session) runProcess(ctx context.Context, cmd *exec.Cmd, name string, labelId uint32, reportExit bool) error {
+	p, err := s.startProcess(cmd, name, labelId)
+	if err != nil {
+		return err
+	}
+	defer killOnDone(ctx, p.pid)()
+	return s.waitProcess(cmd, p, reportExit)
+}
+
+// Returned by Execute for commands still running, done receives the result
+// of waitProcess once the command exits.
+type runningCommand struct {
+	done <-chan error
+}
+
+func (r *runningCommand) Error() string {
+	return "Command is still running"
+}
+
+// Like runProcess, but the command is not listed by Ps.
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	defer killOnDone(ctx, cmd.Process.Pid)()
+	return cmd.Wait()
+}
+
+// exec.CommandContext only kills the shell, children in a pipeline would
+// keep stdout open so waiting never finishes, the whole process group is
+// killed instead. The returned function stops watching ctx.
+func killOnDone(ctx context.Context, pid int) func() {
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(pid)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *Session) startProcess(cmd *exec.Cmd, name string, labelId uint32) (*process, error) {
+	if cmd.SysProcAttr == nil {
+		setProcessGroup(cmd)
+	}
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	p := &process{
+		pid:       cmd.Process.Pid,
+		name:      name,
+		labelId:   labelId,
+		startedAt: time.Now(),
+	}
+	s.mux.Lock()
+	s.processes[p.pid] = p
+	s.mux.Unlock()
+	return p, nil
+}
+
+func (s *Session) waitProcess(cmd *exec.Cmd, p *process, reportExit bool) error {
+	err := cmd.Wait()
+
+	s.mux.Lock()
+	delete(s.processes, p.pid)
+	s.mux.Unlock()
+	if reportExit || err != nil {
+		status := "exit status 0"
+		if err != nil {
+			status = err.Error()
+		}
+		fmt.Fprintf(s.newErrorBuffer(&p.labelId), "%s (pid %d): %s\n", p.name, p.pid, status)
+	}
+	return err
+}
+
+func (s *Session) runningProcesses() []*process {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	processes := make([]*process, 0, len(s.processes))
+	for _, p := range s.processes {
+		processes = append(processes, p)
+	}
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].startedAt.Before(processes[j].startedAt)
+	})
+	return processes
+}
+
+// Kill stops processes matching any of the names, either by pid or by
+// command name. All running processes are stopped when no name is given.
+func (s *Session) killProcesses(names []string) error {
+	killed := 0
+	for _, p := range s.runningProcesses() {
+		commandName := strings.TrimLeft(strings.SplitN(p.name, " ", 2)[0], "|<>")
+		matched := len(names) == 0
+		for _, name := range names {
+			if name == strconv.Itoa(p.pid) || name == commandName {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		err := killProcessGroup(p.pid)
+		if err != nil {
+			return err
+		}
+		killed++
+	}
+	if killed == 0 && len(names) > 0 {
+		return fmt.Errorf("No running process matches %s", strings.Join(names, " "))
+	}
+	return nil
+}
+
+// Ps lists running processes in a +Ps window, which is refreshed each time
+// Ps is executed.
+func (s *Session) listProcesses(storage Storage, pathInfo fullPathInfo) error {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PID\tSTARTED\tWINDOW\tCOMMAND")
+	for _, p := range s.runningProcesses() {
+		window := strconv.Itoa(int(p.labelId))
+		if label := s.Server.Content(p.labelId); label != nil {
+			if path := extractFullPath(label.Delta); len(path) > 0 {
+				window = path
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", p.pid, p.startedAt.Format("15:04:05"), window, p.name)
+	}
+	w.Flush()
+	_, err := s.replaceDummyFile(filepath.Join(windowDirectory(storage, pathInfo), "+Ps"), b.String())
+	return err
+}
@@ -10,18 +10,34 @@ type Range struct {
 	Length uint32 `json:"length"`
 }
 
+// When Ranges is present, all of them shall be highlighted, while Range
+// is the one currently selected. Version is the file version ranges are
+// computed against.
 type Selection struct {
-	Id    uint32 `json:"id"`
-	Range Range  `json:"range"`
+	Id      uint32  `json:"id"`
+	Version uint32  `json:"version,omitempty"`
+	Range   Range   `json:"range"`
+	Ranges  []Range `json:"ranges,omitempty"`
 }
 
+// Top is the index of the first visible character in a content file.
 type Size struct {
 	Id     uint32 `json:"id"`
 	Width  uint32 `json:"width"`
 	Height uint32 `json:"height"`
+	Top    uint32 `json:"top,omitempty"`
+}
+
+// Move describes a window dropped at position(X, Y), both are percentages
+// of the whole screen.
+type Move struct {
+	Id uint32  `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
 }
 
 type Action struct {
+	ActionId  uint32    `json:"action_id,omitempty"`
 	Id        uint32    `json:"id"`
 	Type      string    `json:"type"`
 	Index     uint32    `json:"index"`
@@ -51,6 +67,7 @@ type Request struct {
 	Changes []ot.ClientChange `json:"changes,omitempty"`
 	Acks    map[uint32]uint32 `json:"acks,omitempty"`
 	Sizes   []Size            `json:"sizes,omitempty"`
+	Move    *Move             `json:"move,omitempty"`
 	Action  *Action           `json:"action,omitempty"`
 }
 
@@ -59,8 +76,27 @@ type Hash struct {
 	Version uint32 `json:"version"`
 }
 
+const (
+	ActionDone   = "done"
+	ActionFailed = "failed"
+)
+
+// ActionResult reports the completion of an action tagged with a client
+// generated action ID. ExitCode is only set when an external command exits
+// with a non-zero status.
+type ActionResult struct {
+	ActionId uint32 `json:"action_id"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
 type Update struct {
 	Updates   map[uint32]ot.ServerUpdate `json:"updates,omitempty"`
 	Hashes    map[uint32]Hash            `json:"hashes,omitempty"`
 	Selection *Selection                 `json:"selection,omitempty"`
+	Results   []ActionResult             `json:"results,omitempty"`
+	// Only used when per-client layout is enabled, in this case the layout
+	// here shall be used instead of the one in meta file.
+	Layout string `json:"layout,omitempty"`
 }
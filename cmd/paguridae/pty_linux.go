@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd uintptr, request uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openPty returns master and slave sides of a new pty. Echo is disabled,
+// since typed texts are already shown in the window, so is output
+// processing, which would otherwise turn "\n" into "\r\n".
+func openPty() (*os.File, *os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	err = ioctl(master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var unlock int32
+	err = ioctl(master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	var termios syscall.Termios
+	err = ioctl(slave.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	if err == nil {
+		termios.Lflag &^= syscall.ECHO
+		termios.Oflag &^= syscall.OPOST
+		err = ioctl(slave.Fd(), syscall.TCSETS, uintptr(unsafe.Pointer(&termios)))
+	}
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, err
+	}
+	return master, slave, nil
+}
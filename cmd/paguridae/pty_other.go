@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("Term is only supported on Linux")
+}
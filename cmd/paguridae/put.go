@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// State of a file on disk when it is loaded into or saved from a window,
+// used to detect changes made by others. For partial loads, hash and
+// content only cover the loaded range. Content is kept as the base for
+// three-way merges.
+type diskState struct {
+	stamp   fileStamp
+	hash    [sha256.Size]byte
+	content string
+	format  fileFormat
+}
+
+func (s *Session) recordDiskState(contentId uint32, pathInfo fullPathInfo, content string, format fileFormat) {
+	stamp, err := statStamp(s.windowStorage(contentId), pathInfo.path)
+	if err != nil {
+		return
+	}
+	bufferId := s.bufferId(contentId)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.diskStates[bufferId] = diskState{
+		stamp:   stamp,
+		hash:    sha256.Sum256([]byte(content)),
+		content: content,
+		format:  format,
+	}
+}
+
+// Saving, merging, reloading and paging of a buffer are serialized, so the
+// disk state checked by one of them stays valid until it records a new one.
+func (s *Session) lockBuffer(contentId uint32) func() {
+	bufferId := s.bufferId(contentId)
+	s.mux.Lock()
+	lock, ok := s.bufferLocks[bufferId]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.bufferLocks[bufferId] = lock
+	}
+	s.mux.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (s *Session) loadedDiskState(contentId uint32) (diskState, bool) {
+	bufferId := s.bufferId(contentId)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	state, ok := s.diskStates[bufferId]
+	return state, ok
+}
+
+// When size or modification time changes, content hash is further checked,
+// so touching a file won't be treated as a change. Files removed from disk
+// are not considered changed, since saving them won't lose anything.
+func (s *Session) changedOnDisk(contentId uint32, pathInfo fullPathInfo) (bool, error) {
+	state, ok := s.loadedDiskState(contentId)
+	if !ok {
+		return false, nil
+	}
+	stamp, err := statStamp(s.windowStorage(contentId), pathInfo.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if stamp.same(state.stamp) {
+		return false, nil
+	}
+	content, format, err := s.readWindow(contentId, pathInfo)
+	if err != nil {
+		return false, err
+	}
+	if sha256.Sum256([]byte(content)) != state.hash {
+		return true, nil
+	}
+	s.recordDiskState(contentId, pathInfo, content, format)
+	return false, nil
+}
+
+// Merge changes made on disk into the window, using the content loaded last
+// time as the base of a three-way merge. The result is kept unsaved so it
+// can be reviewed before Put.
+func (s *Session) mergeFile(contentId uint32, pathInfo fullPathInfo) error {
+	defer s.lockBuffer(contentId)()
+	state, ok := s.loadedDiskState(contentId)
+	if !ok {
+		return fmt.Errorf("%s has no loaded content to merge from", pathInfo.path)
+	}
+	theirs, format, err := readPath(s.windowStorage(contentId), pathInfo)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	err = s.Server.Update(contentId, func(d delta.Delta) (delta.Delta, error) {
+		dmp := diffmatchpatch.New()
+		patches := dmp.PatchMake(state.content, DeltaToString(d, true))
+		merged, applied := dmp.PatchApply(patches, theirs)
+		for _, ok := range applied {
+			if !ok {
+				failed++
+			}
+		}
+		return *Diff(d, *delta.New(nil).Insert(merged, nil)), nil
+	})
+	if err != nil {
+		return err
+	}
+	s.recordDiskState(contentId, pathInfo, theirs, format)
+	err = s.markLabels(contentId, `1s/\|\*?!?/|*/`)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d changes cannot be merged into %s, please fix them manually", failed, pathInfo.path)
+	}
+	return nil
+}
+
+var formatters map[string]string
+
+// Formatters read window content from stdin and write formatted content to
+// stdout, the text is diffed into the window as one edit, keeping embeds
+// and attributes. Partially loaded files are not formatted since a page is
+// rarely valid on its own.
+func (s *Session) formatFile(contentId uint32, pathInfo fullPathInfo) error {
+	command, ok := formatters[filepath.Ext(pathInfo.path)]
+	if !ok || pathInfo.partialLoad() {
+		return nil
+	}
+	fileContent := s.Server.Content(contentId)
+	if fileContent == nil {
+		return fmt.Errorf("Cannot find file %d to format!", contentId)
+	}
+	ctx, cancelCmd := context.WithTimeout(context.Background(), CommandTimeoutSeconds*time.Second)
+	defer cancelCmd()
+	cmd := exec.Command(*shell, "-c", command)
+	cmd.Dir = filepath.Dir(pathInfo.path)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("paguridae_file=%s", pathInfo.path))
+	cmd.Stdin = strings.NewReader(DeltaToString(fileContent.Delta, false))
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := runCommand(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("Formatting %s with %s failed, file is not saved: %v\n%s", pathInfo.path, command, err, stderr.String())
+	}
+	formatted := stdout.String()
+	return s.Server.Update(contentId, func(d delta.Delta) (delta.Delta, error) {
+		if DeltaToString(d, false) == formatted {
+			return *delta.New(nil), nil
+		}
+		return *DiffText(d, formatted), nil
+	})
+}
+
+// Save window content to disk, saving is refused when the file has changed
+// on disk since it was loaded, unless force is set. Range of a partially
+// loaded window is read from its label once the buffer is locked, since
+// paging might change it, and is updated to the saved length afterwards.
+func (s *Session) putFile(contentId uint32, pathInfo fullPathInfo, force bool) error {
+	defer s.lockBuffer(contentId)()
+	label := s.Server.Content(contentId - 1)
+	fileContent := s.Server.Content(contentId)
+	if label == nil || fileContent == nil {
+		return fmt.Errorf("Cannot find file %d to save!", contentId)
+	}
+	pathInfo = extractPath(label.Delta)
+	if !force {
+		changed, err := s.changedOnDisk(contentId, pathInfo)
+		if err != nil {
+			return err
+		}
+		if changed {
+			return fmt.Errorf("%s has changed on disk since it was loaded, use Put! to overwrite it or Merge to merge changes", pathInfo.path)
+		}
+	}
+	err := s.formatFile(contentId, pathInfo)
+	if err != nil {
+		return err
+	}
+	fileContent = s.Server.Content(contentId)
+	if fileContent == nil {
+		return fmt.Errorf("Cannot find file %d to save!", contentId)
+	}
+	// Put command here ignores all embeds and just save texts to a file, later
+	// we can add a different command that do save embeds in the buffer
+	state, _ := s.loadedDiskState(contentId)
+	data, err := encodeContent(DeltaToString(fileContent.Delta, false), state.format)
+	if err != nil {
+		return fmt.Errorf("Cannot save %s: %v", pathInfo.path, err)
+	}
+	// Bytes outside of the loaded range are kept from the original file
+	storage := s.windowStorage(contentId)
+	var reader io.Reader = bytes.NewReader(data)
+	if pathInfo.partialLoad() {
+		sourceFileStat, err := storage.Stat(pathInfo.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("Partial loading requires a file that exists!")
+			}
+			return err
+		}
+		sourceFile, err := storage.Open(pathInfo.path)
+		if err != nil {
+			return err
+		}
+		defer sourceFile.Close()
+		remainingStart := *pathInfo.start + *pathInfo.length
+		reader = io.MultiReader(
+			io.NewSectionReader(sourceFile, 0, *pathInfo.start),
+			reader,
+			io.NewSectionReader(sourceFile, remainingStart, sourceFileStat.Size()-remainingStart))
+	}
+	err = storage.WriteFile(pathInfo.path, reader)
+	if err != nil {
+		return err
+	}
+	if pathInfo.partialLoad() {
+		stat, err := storage.Stat(pathInfo.path)
+		if err != nil {
+			return err
+		}
+		length := int64(len(data))
+		pathInfo.length = &length
+		err = s.setPageRange(contentId-1, *pathInfo.start, length, stat.Size())
+		if err != nil {
+			return err
+		}
+	}
+	saved, format, err := readPath(storage, pathInfo)
+	if err != nil {
+		return err
+	}
+	s.recordDiskState(contentId, pathInfo, saved, format)
+	return s.markClean(contentId)
+}
+
+// Save all windows with unsaved changes, failures are reported per file in
+// +Errors, so one failing file won't stop others from being saved.
+func (s *Session) putAll() error {
+	failed := 0
+	for _, window := range s.dirtyWindows() {
+		labelId := window.Id
+		pathInfo := extractPath(window.Delta)
+		if len(pathInfo.path) == 0 {
+			continue
+		}
+		err := s.putFile(labelId+1, pathInfo, false)
+		if err != nil {
+			fmt.Fprintf(s.newErrorBuffer(&labelId), "Error saving %s: %v\n", pathInfo.path, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files cannot be saved", failed)
+	}
+	return nil
+}
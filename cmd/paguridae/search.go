@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+	"xuejie.space/c/go-quill-editor"
+	"xuejie.space/c/paguridae/pkg/ot"
+)
+
+// Texts searched via right click are turned into sam addresses: "/re/"
+// searches forward for a regular expression, "?re?" searches backward, and
+// any other text is searched literally. A trailing "i" after the closing
+// delimiter, such as "/re/i", makes the search case-insensitive. Texts
+// without the closing delimiter, such as "/tmp", are searched literally.
+func searchAddress(text string) string {
+	if len(text) > 2 && (text[0] == '/' || text[0] == '?') {
+		delimiter := text[:1]
+		pattern := text[1:]
+		if strings.HasSuffix(pattern, delimiter+"i") && len(pattern) > 2 {
+			return delimiter + "(?i)" + strings.TrimSuffix(pattern, delimiter+"i") + delimiter
+		} else if strings.HasSuffix(pattern, delimiter) {
+			return delimiter + pattern
+		}
+	}
+	return "/" + strings.ReplaceAll(regexp.QuoteMeta(text), "/", `\/`) + "/"
+}
+
+// Rune offset in decoded content of a byte offset in file data.
+func runeOffset(data []byte, offset int64, format fileFormat) int64 {
+	prefix := data[:offset]
+	if format.bom {
+		prefix = bytes.TrimPrefix(prefix, utf8Bom)
+	}
+	n := int64(len(prefix))
+	if !format.latin1 {
+		n = int64(utf8.RuneCount(prefix))
+	}
+	if format.crlf {
+		n -= int64(bytes.Count(prefix, []byte("\r\n")))
+	}
+	return n
+}
+
+// Byte offset in file data of a rune offset in decoded content.
+func byteOffset(content []rune, offset int64, format fileFormat) int64 {
+	if offset == 0 {
+		return 0
+	}
+	data, _ := encodeContent(string(content[:offset]), format)
+	return int64(len(data))
+}
+
+// Like sam, search starts from the end of dot(or the start of dot when
+// searching backward), and wraps around at either end of the file.
+func samFind(file editor.File, q0 int64, q1 int64, address string) (int64, int64, error) {
+	compiledCmd, err := editor.Compile(fmt.Sprintf("%s=", address))
+	if err != nil {
+		return 0, 0, err
+	}
+	file.Select(q0, q1)
+	err = compiledCmd.Run(editor.Context{
+		File: file,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	q0, q1 = file.Dot()
+	return q0, q1, nil
+}
+
+// Search starts from the clicked text. For partially loaded windows, the
+// whole file on disk is searched, a new page is opened when the match lies
+// outside of current window.
+func (s *Session) searchText(action Action, pathInfo fullPathInfo) (*Selection, bool, error) {
+	update := s.Server.Content(action.ContentId())
+	if update == nil {
+		return nil, false, nil
+	}
+	address := searchAddress(action.Command)
+	q0 := int64(action.Index)
+	q1 := q0 + int64(len([]rune(action.Command)))
+	if !pathInfo.partialLoad() {
+		q0, q1, err := samFind(editor.NewDeltaFile(update.Delta), q0, q1, address)
+		if err != nil {
+			// Search misses are not errors
+			return nil, false, nil
+		}
+		return &Selection{
+			Id:      action.ContentId(),
+			Version: update.Version,
+			Range:   qToRange(q0, q1),
+		}, false, nil
+	}
+	// Window indexes are runes of buffer content, which might be edited
+	// since the page was loaded, while sam searches bytes of the file, so
+	// indexes are mapped through the page as loaded from disk
+	unlock := s.lockBuffer(action.ContentId())
+	label := s.Server.Content(action.LabelId())
+	update = s.Server.Content(action.ContentId())
+	state, ok := s.loadedDiskState(action.ContentId())
+	unlock()
+	if label == nil || update == nil {
+		return nil, false, nil
+	}
+	pathInfo = extractPath(label.Delta)
+	if !pathInfo.partialLoad() {
+		return nil, false, nil
+	}
+	if !ok {
+		state.content = DeltaToString(update.Delta, false)
+	}
+	page, err := encodeContent(state.content, state.format)
+	if err != nil {
+		return nil, false, err
+	}
+	pageRunes := []rune(state.content)
+	pageDelta := *delta.New(nil).Insert(state.content, nil)
+	toDisk := Diff(update.Delta, pageDelta)
+	start := *pathInfo.start
+	b0 := start + byteOffset(pageRunes, int64(ot.TransformIndex(*toDisk, int(q0))), state.format)
+	b1 := start + byteOffset(pageRunes, int64(ot.TransformIndex(*toDisk, int(q1))), state.format)
+	storage := s.windowStorage(action.ContentId())
+	file, err := storage.Open(pathInfo.path)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	samfile, err := samFile(file)
+	if err != nil {
+		return nil, false, err
+	}
+	b0, b1, err = samFind(samfile, b0, b1, address)
+	if err != nil {
+		return nil, false, nil
+	}
+	if b0 >= start && b1 <= start+int64(len(page)) {
+		fromDisk := Diff(pageDelta, update.Delta)
+		r0 := ot.TransformIndex(*fromDisk, int(runeOffset(page, b0-start, state.format)))
+		r1 := ot.TransformIndex(*fromDisk, int(runeOffset(page, b1-start, state.format)))
+		return &Selection{
+			Id:      action.ContentId(),
+			Version: update.Version,
+			Range:   qToRange(int64(r0), int64(r1)),
+		}, false, nil
+	}
+	// Only bytes from the new page start to the match are read, to find
+	// rune offsets of the match in the new page
+	newStart := b0 - 128
+	if newStart < 0 {
+		newStart = 0
+	}
+	_, err = file.Seek(newStart, io.SeekStart)
+	if err != nil {
+		return nil, false, err
+	}
+	data := make([]byte, b1-newStart)
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, false, err
+	}
+	format := fileFormat{
+		latin1: state.format.latin1,
+		crlf:   state.format.crlf,
+		bom:    newStart == 0 && bytes.HasPrefix(data, utf8Bom),
+	}
+	// Pages start at a rune boundary
+	for !format.latin1 && newStart < b0 && !utf8.RuneStart(data[0]) {
+		data = data[1:]
+		newStart++
+	}
+	newLength := int64(*pageSize)
+	if b1-newStart > newLength {
+		newLength = b1 - newStart
+	}
+	pathInfo.start, pathInfo.length = &newStart, &newLength
+	pathInfo.location = fmt.Sprintf("#%d,#%d", runeOffset(data, b0-newStart, format), runeOffset(data, b1-newStart, format))
+	return s.openFile(storage, pathInfo)
+}
@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -92,7 +93,10 @@ func parseFullPath(fullPath string) (info fullPathInfo) {
 		log.Printf("Error extracting path from %s", fullPath)
 		return
 	}
-	info.path = filepath.Clean(matches[4])
+	// Scratch windows have no path, which shall not be cleaned into "."
+	if len(matches[4]) > 0 {
+		info.path = filepath.Clean(matches[4])
+	}
 	if len(parts) == 2 {
 		info.location = parts[1]
 	}
@@ -121,13 +125,43 @@ type Session struct {
 	VerifyContent bool
 
 	clientFlushChans map[uuid.UUID](chan bool)
+	lookTexts        map[uint32]string
+	diskStates       map[uint32]diskState
+	bufferLocks      map[uint32]*sync.Mutex
+	processes        map[int]*process
+	terms            map[uint32]*term
+	listings         map[uint32]listingOptions
+	perClientLayout  bool
+	clientLayouts    map[uuid.UUID]*clientLayout
+	sizes            map[uint32]Size
 	listenPath       string
 	listener         net.Listener
 	listenerSignal   chan bool
-	mux              sync.Mutex
+	watcherSignal    chan bool
+	exitSignal       chan bool
+	// Dirty windows reported by last Delall, repeating Delall with the same
+	// dirty windows discards their changes.
+	delallWarning string
+	// Content versions and texts already highlighted, and files waiting to be
+	// highlighted again.
+	highlighted      map[uint32]uint32
+	highlightedTexts map[uint32]string
+	highlightQueue   map[uint32]bool
+	highlightSignal  chan bool
+	// Language servers keyed by command and project root.
+	lspClients map[string]*lspClient
+	// Paged windows currently loading more pages.
+	paging map[uint32]bool
+	// Snarf buffer shared by all clients of the session.
+	snarfBuffer string
+	// Storage used by new windows, and storages windows are bound to when
+	// created, keyed by buffer ID.
+	storage  Storage
+	storages map[uint32]Storage
+	mux      sync.Mutex
 }
 
-func NewSession(verifyContent bool) (*Session, error) {
+func NewSession(verifyContent bool, perClientLayout bool) (*Session, error) {
 	sessionId := uuid.New()
 	listenPath := fmt.Sprintf("/tmp/paguridae/%s", sessionId)
 	listenDirectory := filepath.Dir(listenPath)
@@ -161,17 +195,44 @@ func NewSession(verifyContent bool) (*Session, error) {
 		Server:           server,
 		VerifyContent:    verifyContent,
 		clientFlushChans: make(map[uuid.UUID](chan bool)),
+		lookTexts:        make(map[uint32]string),
+		diskStates:       make(map[uint32]diskState),
+		bufferLocks:      make(map[uint32]*sync.Mutex),
+		processes:        make(map[int]*process),
+		terms:            make(map[uint32]*term),
+		listings:         make(map[uint32]listingOptions),
+		perClientLayout:  perClientLayout,
+		clientLayouts:    make(map[uuid.UUID]*clientLayout),
+		sizes:            make(map[uint32]Size),
 		listenPath:       listenPath,
 		listener:         listener,
 		listenerSignal:   make(chan bool),
+		watcherSignal:    make(chan bool),
+		exitSignal:       make(chan bool),
+		highlighted:      make(map[uint32]uint32),
+		highlightedTexts: make(map[uint32]string),
+		highlightQueue:   make(map[uint32]bool),
+		highlightSignal:  make(chan bool, 1),
+		lspClients:       make(map[string]*lspClient),
+		paging:           make(map[uint32]bool),
+		storage:          LocalStorage{},
+		storages:         make(map[uint32]Storage),
 	}
 
-	metaFileChan := make(chan bool)
+	// Refreshing reads all files, so pending refreshes are merged, events
+	// must keep flowing since the OT server blocks until they are received.
+	metaFileChan := make(chan bool, 1)
 	go func() {
 		for event := range userEvents {
 			if len(event.CreatedFileIds) > 0 ||
 				len(event.ClosedFileIds) > 0 {
-				metaFileChan <- true
+				select {
+				case metaFileChan <- true:
+				default:
+				}
+			}
+			if *syntaxHighlight && len(event.Updates) > 0 {
+				session.scheduleHighlight(event.Updates)
 			}
 		}
 	}()
@@ -188,29 +249,45 @@ func NewSession(verifyContent bool) (*Session, error) {
 		server.Stop()
 		return nil, fmt.Errorf("Unexpected meta file ID: %d", ids[0])
 	}
-	// A new session has 2 files: an empty one, and one showing
-	// contents from current directory
-	currentPath, err := os.Getwd()
+	if len(*loadDump) > 0 {
+		err = session.Load(*loadDump)
+		if err != nil {
+			fmt.Fprintf(session.newErrorBuffer(nil), "Error loading dump %s: %v\n", *loadDump, err)
+			err = session.createInitialFiles()
+		}
+	} else {
+		err = session.createInitialFiles()
+	}
 	if err != nil {
 		server.Stop()
 		return nil, err
 	}
-	_, err = session.CreateDummyFile()
+	err = Start9PFileSystem(session)
 	if err != nil {
 		server.Stop()
 		return nil, err
 	}
-	err = session.CreateDirectoryListingFile(currentPath)
+	if *syntaxHighlight {
+		go session.highlightFiles()
+	}
+	if *watchInterval > 0 {
+		go session.watchFiles(time.Duration(*watchInterval) * time.Second)
+	}
+	return session, nil
+}
+
+// A new session has 2 files: an empty one, and one showing
+// contents from current directory
+func (s *Session) createInitialFiles() error {
+	currentPath, err := os.Getwd()
 	if err != nil {
-		server.Stop()
-		return nil, err
+		return err
 	}
-	err = Start9PFileSystem(session)
+	_, err = s.CreateDummyFile()
 	if err != nil {
-		server.Stop()
-		return nil, err
+		return err
 	}
-	return session, nil
+	return s.CreateDirectoryListingFile(parseFullPath(currentPath))
 }
 
 func (s *Session) Id() uuid.UUID {
@@ -260,55 +337,52 @@ func (s *Session) Flush() {
 }
 
 func (s *Session) Stop() {
+	s.killProcesses(nil)
+	close(s.watcherSignal)
 	close(s.listenerSignal)
 	s.listener.Close()
 	os.Remove(s.listenPath)
 	s.Server.Stop()
 }
 
-func idToMeta(id uint32) delta.Delta {
-	return *delta.New(nil).Insert(fmt.Sprintf("%d 0 0\n", id), nil)
+// Exiting returns a channel which is closed when the session exits,
+// connections shall then be closed.
+func (s *Session) Exiting() <-chan bool {
+	return s.exitSignal
+}
+
+// OT server cannot serve connections once stopped, so Exit waits for
+// connections to close before stopping the session.
+func (s *Session) Exit() {
+	close(s.exitSignal)
+	for i := 0; i < 100 && s.Connections() > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	s.Stop()
 }
 
 func (s *Session) refreshMetafile() error {
-	return s.Server.UpdateAll(func(changes []ot.ServerUpdate) ([]ot.ClientChange, error) {
+	err := s.Server.UpdateAll(func(changes []ot.ServerUpdate) ([]ot.ClientChange, error) {
 		var oldMeta *ot.ServerUpdate
-		for _, change := range changes {
+		labelIds := make([]uint32, 0)
+		for i, change := range changes {
 			if change.Id == MetaFileId {
-				oldMeta = &change
-				break
+				oldMeta = &changes[i]
+			} else if change.Id%2 != 0 {
+				labelIds = append(labelIds, change.Id)
 			}
 		}
 		if oldMeta == nil {
 			return nil, fmt.Errorf("Metafile does not exist, something is seriously wrong!")
 		}
-		oldInfos := make(map[uint32]string)
-		for _, line := range strings.Split(DeltaToString(oldMeta.Delta, true), "\n") {
-			if len(line) == 0 {
-				continue
-			}
-			pieces := strings.SplitN(line, " ", 2)
-			if len(pieces) != 2 {
-				return nil, fmt.Errorf("Invalid split for line: %s", line)
-			}
-			i, err := strconv.ParseUint(pieces[0], 10, 32)
-			if err != nil {
-				return nil, fmt.Errorf("Unexpected parse error: %v", err)
-			}
-			oldInfos[uint32(i)] = line
-		}
-		newMetaContent := delta.New(nil)
-		for _, change := range changes {
-			if change.Id != MetaFileId {
-				line, ok := oldInfos[change.Id]
-				if ok {
-					newMetaContent = newMetaContent.Concat(*delta.New(nil).Insert(line, nil).Insert("\n", nil))
-				} else {
-					newMetaContent = newMetaContent.Concat(idToMeta(change.Id))
-				}
-			}
+		layout, err := ParseLayout(DeltaToString(oldMeta.Delta, true))
+		if err != nil {
+			return nil, err
+		}
+		if !layout.Sync(labelIds) {
+			return nil, nil
 		}
-		d := Diff(oldMeta.Delta, *newMetaContent)
+		d := Diff(oldMeta.Delta, layout.Delta())
 		return []ot.ClientChange{
 			{
 				Id:    MetaFileId,
@@ -317,6 +391,22 @@ func (s *Session) refreshMetafile() error {
 			},
 		}, nil
 	})
+	if err != nil || !s.perClientLayout {
+		return err
+	}
+	shared, err := s.sharedLayout()
+	if err != nil {
+		return err
+	}
+	ids := shared.Ids()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, l := range s.clientLayouts {
+		if l.layout.Sync(ids) {
+			l.version++
+		}
+	}
+	return nil
 }
 
 func (s *Session) closeFile(fileId uint32) {
@@ -329,15 +419,46 @@ func (s *Session) createFile(label string, content *string) (uint32, error) {
 		contentDelta = contentDelta.Insert(*content, nil)
 	}
 	ids := s.Server.CreateFiles(*delta.New(nil).Insert(label, nil), *contentDelta)
+	if len(ids) != 2 {
+		return 0, fmt.Errorf("Cannot create files for %s", label)
+	}
 	labelId := ids[0]
 	contentId := ids[1]
 	if labelId%2 != 1 || contentId != labelId+1 {
 		s.Server.CloseFiles(labelId, contentId)
 		return 0, fmt.Errorf("Unexpected allocated file IDs: %d %d", labelId, contentId)
 	}
+	s.bindStorage(contentId, s.Storage())
 	return contentId, nil
 }
 
+// Zerox opens another view of a window, with its own label and selection,
+// while the content file is shared, see CreateAliasedFiles.
+func (s *Session) zerox(contentId uint32) (*Selection, bool, error) {
+	label := s.Server.Content(contentId - 1)
+	if label == nil {
+		return nil, false, fmt.Errorf("Cannot find label file: %d", contentId-1)
+	}
+	ids := s.Server.CreateAliasedFiles([]delta.Delta{label.Delta, *delta.New(nil)}, []uint32{0, contentId})
+	if len(ids) != 2 {
+		return nil, false, fmt.Errorf("Cannot create a view of file %d", contentId)
+	}
+	if ids[0]%2 != 1 || ids[1] != ids[0]+1 {
+		s.Server.CloseFiles(ids...)
+		return nil, false, fmt.Errorf("Unexpected allocated file IDs: %d %d", ids[0], ids[1])
+	}
+	return &Selection{Id: ids[1]}, true, nil
+}
+
+// States kept per content file, such as disk states, are keyed by the
+// lowest ID of all views sharing the content.
+func (s *Session) bufferId(contentId uint32) uint32 {
+	if views := s.Server.Aliases(contentId); len(views) > 0 {
+		return views[0]
+	}
+	return contentId
+}
+
 func (s *Session) CreateDummyFile() (uint32, error) {
 	return s.createFile(DefaultLabel, nil)
 }
@@ -354,20 +475,56 @@ func (s *Session) FindOrCreateDummyFile(path string) (uint32, error) {
 	return s.createFile(fmt.Sprintf("%s%s", path, DefaultLabel), nil)
 }
 
-func (s *Session) CreateDirectoryListingFile(path string) error {
-	if !strings.HasSuffix(path, "/") {
-		path += "/"
+// Scratch windows showing command results are refreshed in place.
+func (s *Session) replaceDummyFile(path string, content string) (uint32, error) {
+	contentId, err := s.FindOrCreateDummyFile(path)
+	if err != nil {
+		return 0, err
 	}
-	cmd := exec.Command("ls", "-F", path)
-	var out strings.Builder
-	cmd.Stdout = &out
-	err := cmd.Run()
+	return contentId, s.Server.Update(contentId, func(d delta.Delta) (delta.Delta, error) {
+		return *Diff(d, *delta.New(nil).Insert(content, nil)), nil
+	})
+}
+
+// Read current content of a path, directories are listed, while partial
+// loading ranges are respected for files. Format of files is detected so
+// Put can store content the same way.
+func readPath(storage Storage, pathInfo fullPathInfo) (string, fileFormat, error) {
+	stat, err := storage.Stat(pathInfo.path)
 	if err != nil {
-		return err
+		return "", fileFormat{}, err
+	}
+	if stat.IsDir() {
+		content, _, err := listDirectory(storage, pathInfo, listingOptions{})
+		return content, fileFormat{}, err
+	}
+	file, err := storage.Open(pathInfo.path)
+	if err != nil {
+		return "", fileFormat{}, err
 	}
-	content := out.String()
-	_, err = s.createFile(fmt.Sprintf("%s%s", path, DefaultLabel), &content)
-	return err
+	defer file.Close()
+	var reader io.Reader = file
+	if pathInfo.partialLoad() {
+		_, err = file.Seek(*pathInfo.start, os.SEEK_SET)
+		if err != nil {
+			return "", fileFormat{}, err
+		}
+		reader = io.LimitReader(file, *pathInfo.length)
+	}
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", fileFormat{}, err
+	}
+	return decodeContent(content)
+}
+
+// Directory of a window is the directory listed in it, or the directory
+// containing the file shown in it.
+func windowDirectory(storage Storage, pathInfo fullPathInfo) string {
+	if isDirectory(storage, pathInfo.path) {
+		return pathInfo.path
+	}
+	return filepath.Dir(pathInfo.path)
 }
 
 // Sam search error is ignored here.
@@ -405,11 +562,17 @@ func qToRange(q0 int64, q1 int64) Range {
 }
 
 func (s *Session) FindOrOpenFile(pathInfo fullPathInfo) (*Selection, bool, error) {
+	return s.openFile(s.Storage(), pathInfo)
+}
+
+// Windows are only reused when they show the same storage, new windows are
+// bound to storage.
+func (s *Session) openFile(storage Storage, pathInfo fullPathInfo) (*Selection, bool, error) {
 	allContents := s.Server.AllContents()
 	var labelId uint32
 	for _, change := range allContents {
 		if change.Id%2 != 0 {
-			if pathInfo.same(extractPath(change.Delta)) {
+			if pathInfo.same(extractPath(change.Delta)) && s.windowStorage(change.Id+1) == storage {
 				labelId = change.Id
 				break
 			}
@@ -420,21 +583,23 @@ func (s *Session) FindOrOpenFile(pathInfo fullPathInfo) (*Selection, bool, error
 		for _, change := range allContents {
 			if change.Id == contentId {
 				return &Selection{
-					Id:    contentId,
-					Range: qToRange(samSearch(editor.NewDeltaFile(change.Delta), pathInfo.location)),
+					Id:      contentId,
+					Version: change.Version,
+					Range:   qToRange(samSearch(editor.NewDeltaFile(change.Delta), pathInfo.location)),
 				}, false, nil
 			}
 		}
 		return nil, false, fmt.Errorf("Label file %d is found but content file %d is missing!", labelId, contentId)
 	}
-	file, err := os.Open(pathInfo.path)
+	stat, err := storage.Stat(pathInfo.path)
 	if err != nil {
 		return nil, false, err
 	}
-	stat, err := file.Stat()
+	file, err := storage.Open(pathInfo.path)
 	if err != nil {
 		return nil, false, err
 	}
+	defer file.Close()
 	var selectedRange *Range
 	if pathInfo.partialLoad() {
 		if *pathInfo.start < 0 {
@@ -447,7 +612,11 @@ func (s *Session) FindOrOpenFile(pathInfo fullPathInfo) (*Selection, bool, error
 	} else if stat.Size() > int64(*pageSize) {
 		// When path does not specify a partial loading range, one can use sam command
 		// to search and jump to a place directly.
-		q0, q1 := samSearch(editor.NewGoFile(file), pathInfo.location)
+		samfile, err := samFile(file)
+		if err != nil {
+			return nil, false, err
+		}
+		q0, q1 := samSearch(samfile, pathInfo.location)
 		start, length := int64(0), int64(*pageSize)
 		if q1-q0 > 0 {
 			start = q0 - 128
@@ -479,15 +648,41 @@ func (s *Session) FindOrOpenFile(pathInfo fullPathInfo) (*Selection, bool, error
 			return nil, false, err
 		}
 	}
-	_, err = file.Read(content)
+	_, err = io.ReadFull(file, content)
 	if err != nil {
 		return nil, false, err
 	}
-	contentString := string(content)
+	if pathInfo.partialLoad() {
+		oldStart := *pathInfo.start
+		content, *pathInfo.start = alignPage(content, oldStart, oldStart+*pathInfo.length >= stat.Size())
+		*pathInfo.length = int64(len(content))
+		label = fmt.Sprintf("(%d,%d,%d)%s%s", *pathInfo.start, *pathInfo.length, stat.Size(), pathInfo.path, DefaultLabel)
+		if shift := uint32(*pathInfo.start - oldStart); selectedRange != nil && selectedRange.Index >= shift {
+			selectedRange.Index -= shift
+		}
+	}
+	contentString, format, err := decodeContent(content)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %v", pathInfo.path, err)
+	}
+	if contentId := s.pagedWindow(storage, pathInfo.path); contentId != 0 && selectedRange != nil {
+		// Clean paged window of the file jumps to the page instead
+		err = s.movePage(contentId, pathInfo, stat.Size(), contentString, format)
+		if err != nil {
+			return nil, false, err
+		}
+		var version uint32
+		if content := s.Server.Content(contentId); content != nil {
+			version = content.Version
+		}
+		return &Selection{Id: contentId, Version: version, Range: *selectedRange}, false, nil
+	}
 	contentId, err := s.createFile(label, &contentString)
 	if err != nil {
 		return nil, false, err
 	}
+	s.bindStorage(contentId, storage)
+	s.recordDiskState(contentId, pathInfo, contentString, format)
 	if err != nil {
 		return nil, false, err
 	}
@@ -498,14 +693,130 @@ func (s *Session) FindOrOpenFile(pathInfo fullPathInfo) (*Selection, bool, error
 		selectedRange = &r
 	}
 	return &Selection{
-		Id:    contentId,
-		Range: *selectedRange,
+		Id: contentId,
+		// Newly created files always start at version 1
+		Version: 1,
+		Range:   *selectedRange,
 	}, true, nil
 }
 
+// Reload window content from disk, changes are submitted as a diff, so
+// collaborators only see a minimal edit, and undo still works.
+func (s *Session) reloadFile(contentId uint32, pathInfo fullPathInfo) error {
+	defer s.lockBuffer(contentId)()
+	content, format, err := s.readWindow(contentId, pathInfo)
+	if err != nil {
+		return err
+	}
+	s.recordDiskState(contentId, pathInfo, content, format)
+	current := s.Server.Content(contentId)
+	if current != nil && DeltaToString(current.Delta, true) == content {
+		return s.markClean(contentId)
+	}
+	err = s.Server.Update(contentId, func(d delta.Delta) (delta.Delta, error) {
+		return *Diff(d, *delta.New(nil).Insert(content, nil)), nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.markClean(contentId)
+}
+
+// Content shared by other views is only released with its last view.
 func (s *Session) deleteFile(action Action) {
+	views := s.Server.Aliases(action.ContentId())
 	s.closeFile(action.LabelId())
 	s.closeFile(action.ContentId())
+	if len(views) <= 1 {
+		s.closeTerm(action.ContentId())
+	}
+
+	s.mux.Lock()
+	if len(views) > 1 && views[0] == action.ContentId() {
+		if state, ok := s.diskStates[views[0]]; ok {
+			s.diskStates[views[1]] = state
+		}
+		if options, ok := s.listings[views[0]]; ok {
+			s.listings[views[1]] = options
+		}
+		if storage, ok := s.storages[views[0]]; ok {
+			s.storages[views[1]] = storage
+		}
+		if t, ok := s.terms[views[0]]; ok {
+			t.contentId = views[1]
+			s.terms[views[1]] = t
+			delete(s.terms, views[0])
+		}
+	}
+	delete(s.lookTexts, action.ContentId())
+	delete(s.diskStates, action.ContentId())
+	delete(s.bufferLocks, action.ContentId())
+	delete(s.listings, action.ContentId())
+	delete(s.storages, action.ContentId())
+	delete(s.highlighted, action.ContentId())
+	delete(s.highlightedTexts, action.ContentId())
+	s.mux.Unlock()
+}
+
+func (s *Session) dirtyWindows() []ot.ServerUpdate {
+	windows := make([]ot.ServerUpdate, 0)
+	for _, change := range s.Server.AllContents() {
+		if change.Id != MetaFileId && change.Id%2 != 0 &&
+			isDirtyLabel(DeltaToString(change.Delta, false)) {
+			windows = append(windows, change)
+		}
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Id < windows[j].Id })
+	return windows
+}
+
+func (s *Session) deleteAll() error {
+	dirtyWindows := s.dirtyWindows()
+	names := make([]string, len(dirtyWindows))
+	for i, window := range dirtyWindows {
+		names[i] = extractFullPath(window.Delta)
+		if len(names[i]) == 0 {
+			names[i] = fmt.Sprintf("window %d", window.Id)
+		}
+	}
+	warning := strings.Join(names, ", ")
+	s.mux.Lock()
+	warned := s.delallWarning == warning
+	s.delallWarning = ""
+	if len(dirtyWindows) > 0 && !warned {
+		s.delallWarning = warning
+	}
+	s.mux.Unlock()
+	if len(dirtyWindows) > 0 && !warned {
+		return fmt.Errorf("Unsaved changes in %s, use Delall again to discard them", warning)
+	}
+	s.closeAllFiles()
+	return nil
+}
+
+// Closes all windows, along with their terms and per window states.
+func (s *Session) closeAllFiles() {
+	fileIds := make([]uint32, 0)
+	for _, change := range s.Server.AllContents() {
+		if change.Id != MetaFileId {
+			fileIds = append(fileIds, change.Id)
+		}
+	}
+	if len(fileIds) > 0 {
+		s.Server.CloseFiles(fileIds...)
+	}
+	for _, fileId := range fileIds {
+		s.closeTerm(fileId)
+	}
+	s.mux.Lock()
+	s.lookTexts = make(map[uint32]string)
+	s.diskStates = make(map[uint32]diskState)
+	s.bufferLocks = make(map[uint32]*sync.Mutex)
+	s.listings = make(map[uint32]listingOptions)
+	s.storages = make(map[uint32]Storage)
+	s.highlighted = make(map[uint32]uint32)
+	s.highlightedTexts = make(map[uint32]string)
+	s.mux.Unlock()
 }
 
 func (s *Session) editFile(action Action) {
@@ -545,10 +856,108 @@ func (s *Session) editFile(action Action) {
 	}
 }
 
+func findAllRunes(content []rune, target []rune) []Range {
+	ranges := make([]Range, 0)
+	if len(target) == 0 {
+		return ranges
+	}
+	for start := 0; start+len(target) <= len(content); start++ {
+		found := true
+		for j := range target {
+			if content[start+j] != target[j] {
+				found = false
+				break
+			}
+		}
+		if found {
+			ranges = append(ranges, Range{
+				Index:  uint32(start),
+				Length: uint32(len(target)),
+			})
+			start += len(target) - 1
+		}
+	}
+	return ranges
+}
+
+// Look highlights all occurrences of text in current window, the first one
+// after current selection gets selected. Running Look without an argument
+// steps through occurrences of the text looked up last time.
+func (s *Session) look(action Action, text string) (*Selection, bool, error) {
+	contentId := action.ContentId()
+	s.mux.Lock()
+	if len(text) > 0 {
+		s.lookTexts[contentId] = text
+	} else {
+		text = s.lookTexts[contentId]
+	}
+	s.mux.Unlock()
+	if len(text) == 0 {
+		return nil, false, nil
+	}
+	content := s.Server.Content(contentId)
+	if content == nil {
+		return nil, false, fmt.Errorf("Cannot find file %d to look up!", contentId)
+	}
+	ranges := findAllRunes(DeltaToRunes(content.Delta, true), []rune(text))
+	if len(ranges) == 0 {
+		return nil, false, fmt.Errorf("No match for %s", text)
+	}
+	var after uint32
+	if action.Selection.Id == contentId {
+		after = action.Selection.Range.Index + action.Selection.Range.Length
+	}
+	// Wrap around when there is no more match after current selection
+	current := ranges[0]
+	for _, r := range ranges {
+		if r.Index >= after {
+			current = r
+			break
+		}
+	}
+	return &Selection{
+		Id:      contentId,
+		Version: content.Version,
+		Range:   current,
+		Ranges:  ranges,
+	}, false, nil
+}
+
+// TransformSelection moves a selection to target version of the file, so
+// concurrent edits happening after the selection is computed won't shift it
+// to a wrong place. The original selection is kept when the transform fails.
+func (s *Session) TransformSelection(selection Selection, target uint32) Selection {
+	if selection.Version == 0 || selection.Version == target {
+		return selection
+	}
+	ranges := append([]Range{selection.Range}, selection.Ranges...)
+	indexes := make([]int, 0, len(ranges)*2)
+	for _, r := range ranges {
+		indexes = append(indexes, int(r.Index), int(r.Index+r.Length))
+	}
+	indexes, err := s.Server.TransformIndexes(selection.Id, selection.Version, target, indexes)
+	if err != nil {
+		log.Printf("Error transforming selection: %v", err)
+		return selection
+	}
+	for i := range ranges {
+		ranges[i] = qToRange(int64(indexes[i*2]), int64(indexes[i*2+1]))
+	}
+	selection.Version = target
+	selection.Range = ranges[0]
+	if len(selection.Ranges) > 0 {
+		selection.Ranges = ranges[1:]
+	}
+	return selection
+}
+
 func (s *Session) newErrorBuffer(labelId *uint32) *errorsBufferWriter {
 	var path string
 	if labelId != nil {
-		path = filepath.Dir(extractPath(s.Server.Content(*labelId).Delta).path)
+		// Window might be closed while a command is still running
+		if label := s.Server.Content(*labelId); label != nil {
+			path = filepath.Dir(extractPath(label.Delta).path)
+		}
 	}
 	return &errorsBufferWriter{
 		path: path,
@@ -570,12 +979,29 @@ func (s *Session) runSamCommand(fileId uint32, cmd string) error {
 	})
 }
 
+var DirtyLabelRe = regexp.MustCompile(`^(?:[^ \n\|]+\s+)?(\|\*)`)
+
+func isDirtyLabel(label string) bool {
+	return DirtyLabelRe.MatchString(label)
+}
+
 func (s *Session) markDirty(contentId uint32) error {
-	return s.runSamCommand(contentId-1, `1s/\|\*?/|*/`)
+	return s.markLabels(contentId, `1s/\|\*?/|*/`)
 }
 
 func (s *Session) markClean(contentId uint32) error {
-	return s.runSamCommand(contentId-1, `1s/\|\*/|/`)
+	return s.markLabels(contentId, `1s/\|\*?!?/|/`)
+}
+
+// Labels of all views sharing the content are marked.
+func (s *Session) markLabels(contentId uint32, command string) error {
+	for _, id := range s.Server.Aliases(contentId) {
+		err := s.runSamCommand(id-1, command)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *Session) ApplyChanges(clientId uuid.UUID, changes []ot.ClientChange) error {
@@ -583,7 +1009,7 @@ func (s *Session) ApplyChanges(clientId uuid.UUID, changes []ot.ClientChange) er
 		// Ignore client changes to meta file.
 		if change.Id > 0 {
 			s.Server.Submit(&clientId, change)
-			err := s.markDirty(change.Id)
+			err := s.contentChanged(change.Id)
 			if err != nil {
 				return err
 			}
@@ -592,6 +1018,15 @@ func (s *Session) ApplyChanges(clientId uuid.UUID, changes []ot.ClientChange) er
 	return nil
 }
 
+// Lines typed into Term windows are sent to the shell, other windows are
+// marked dirty.
+func (s *Session) contentChanged(contentId uint32) error {
+	if t := s.findTerm(contentId); t != nil {
+		return s.termInput(contentId, t)
+	}
+	return s.markDirty(contentId)
+}
+
 func (s *Session) Execute(clientId uuid.UUID, action Action) (*Selection, bool, error) {
 	labelContent := s.Server.Content(action.LabelId())
 	if labelContent == nil {
@@ -603,68 +1038,23 @@ func (s *Session) Execute(clientId uuid.UUID, action Action) (*Selection, bool,
 		if action.Command == "" {
 			return nil, false, nil
 		}
-		var fullPath string
-		if AbsolutePathRe.MatchString(action.Command) {
-			fullPath = action.Command
-		} else {
-			fullPath = labelPath
-			if !strings.HasSuffix(fullPath, "/") {
-				fullPath += "/../"
-			}
-			fullPath += action.Command
+		selection, created, ok, err := s.plumb(action, labelPath)
+		if ok {
+			return selection, created, err
 		}
-		pathInfo := parseFullPath(fullPath)
-		stat, err := os.Stat(pathInfo.path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				update := s.Server.Content(action.ContentId())
-				if update == nil {
-					return nil, false, nil
-				}
-				content := DeltaToRunes(update.Delta, false)
-				target := []rune(action.Command)
-				length := uint32(len(target))
-				start := action.Index + length
-				var found bool
-				for ; start+length <= uint32(len(content)); start++ {
-					found = true
-					for j := range target {
-						if content[int(start)+j] != target[j] {
-							found = false
-							break
-						}
-					}
-					if found {
-						break
-					}
-				}
-				if found {
-					return &Selection{
-						Id: action.ContentId(),
-						Range: Range{
-							Index:  start,
-							Length: length,
-						},
-					}, false, nil
-				} else {
-					return nil, false, nil
-				}
-			} else {
-				return nil, false, err
-			}
-		}
-		if stat.IsDir() {
-			err = s.CreateDirectoryListingFile(pathInfo.path)
-		} else {
-			return s.FindOrOpenFile(pathInfo)
+		selection, created, ok, err = s.openPath(s.windowStorage(action.ContentId()), resolvePath(labelPath, action.Command))
+		if ok {
+			return selection, created, err
 		}
-		if err != nil {
-			return nil, false, err
+		selection, created, ok = s.lspDefinition(action)
+		if ok {
+			return selection, created, nil
 		}
-		return nil, false, err
+		return s.searchText(action, parseFullPath(labelPath))
 	} else if action.Type == "execute" {
-		aSelection, aSelectionCreated, err := s.execute(parseFullPath(labelPath), action)
-		if err != nil {
+		aSelection, aSelectionCreated, err := s.execute(clientId, parseFullPath(labelPath), action)
+		var running *runningCommand
+		if err != nil && !errors.As(err, &running) {
 			s.newErrorBuffer(nil).Write([]byte(fmt.Sprintf("Execution error: %v", err)))
 		}
 		return aSelection, aSelectionCreated, err
@@ -684,15 +1074,58 @@ func parseScrollSize(commands []string) int64 {
 	return scrollInt
 }
 
-func (s *Session) execute(pathInfo fullPathInfo, action Action) (*Selection, bool, error) {
+func (s *Session) execute(clientId uuid.UUID, pathInfo fullPathInfo, action Action) (*Selection, bool, error) {
 	commands := strings.Split(action.Command, " ")
 	switch commands[0] {
 	case "New":
 		_, err := s.CreateDummyFile()
 		return nil, false, err
+	case "Newcol":
+		return nil, false, s.updateLayout(clientId, func(l *Layout) {
+			l.CreateColumn()
+		})
+	case "Delcol":
+		return nil, false, s.updateLayout(clientId, func(l *Layout) {
+			l.RemoveColumn(action.LabelId())
+		})
 	case "Del":
 		s.deleteFile(action)
 		return nil, false, nil
+	case "Snarf", "Cut":
+		return nil, false, s.snarf(action.Selection, commands[0] == "Cut")
+	case "Paste":
+		return nil, false, s.paste(action.Selection)
+	case "Zerox":
+		return s.zerox(action.ContentId())
+	case "Storage":
+		return nil, false, s.switchStorage(s.windowStorage(action.ContentId()), pathInfo, strings.Fields(action.Command)[1:])
+	case "Delall":
+		return nil, false, s.deleteAll()
+	case "Putall":
+		return nil, false, s.putAll()
+	case "Kill":
+		return nil, false, s.killProcesses(strings.Fields(action.Command)[1:])
+	case "Ps":
+		return nil, false, s.listProcesses(s.windowStorage(action.ContentId()), pathInfo)
+	case "Term":
+		return nil, false, s.createTerm(s.windowStorage(action.ContentId()), pathInfo)
+	case "Intr", "Eof":
+		return nil, false, s.termControl(action.ContentId(), commands[0])
+	case "Exit":
+		// Session is torn down after the action returns
+		go sessionManager.ExitSession(s.Id())
+		return nil, false, nil
+	case "Dump", "Load":
+		file, err := dumpFilePath(s.windowStorage(action.ContentId()), pathInfo, commands[1:])
+		if err != nil {
+			return nil, false, err
+		}
+		if commands[0] == "Dump" {
+			return nil, false, s.Dump(file)
+		}
+		return nil, false, s.Load(file)
+	case "Look":
+		return s.look(action, strings.TrimSpace(strings.TrimPrefix(action.Command, "Look")))
 	case "Undo":
 		// Undo error is ignored
 		s.Server.Undo(action.ContentId())
@@ -705,15 +1138,21 @@ func (s *Session) execute(pathInfo fullPathInfo, action Action) (*Selection, boo
 		if !pathInfo.partialLoad() {
 			return nil, false, nil
 		}
+		if isDirectory(s.windowStorage(action.ContentId()), pathInfo.path) {
+			return nil, false, s.pageDirectoryListing(action.ContentId(), pathInfo, true)
+		}
 		newStart := *pathInfo.start + parseScrollSize(commands)
 		newLength := int64(*pageSize)
 		pathInfo.start = &newStart
 		pathInfo.length = &newLength
-		return s.FindOrOpenFile(pathInfo)
+		return s.openFile(s.windowStorage(action.ContentId()), pathInfo)
 	case "Prev":
 		if !pathInfo.partialLoad() {
 			return nil, false, nil
 		}
+		if isDirectory(s.windowStorage(action.ContentId()), pathInfo.path) {
+			return nil, false, s.pageDirectoryListing(action.ContentId(), pathInfo, false)
+		}
 		newStart := *pathInfo.start - parseScrollSize(commands)
 		if newStart < 0 {
 			newStart = 0
@@ -721,151 +1160,109 @@ func (s *Session) execute(pathInfo fullPathInfo, action Action) (*Selection, boo
 		newLength := int64(*pageSize)
 		pathInfo.start = &newStart
 		pathInfo.length = &newLength
-		return s.FindOrOpenFile(pathInfo)
-	case "Put":
-		if action.Id == MetaFileId || len(pathInfo.path) == 0 {
+		return s.openFile(s.windowStorage(action.ContentId()), pathInfo)
+	case "Open":
+		return s.openFuzzy(s.windowStorage(action.ContentId()), pathInfo, strings.TrimSpace(strings.TrimPrefix(action.Command, "Open")))
+	case "Grep":
+		return nil, false, s.grep(s.windowStorage(action.ContentId()), pathInfo, strings.TrimSpace(strings.TrimPrefix(action.Command, "Grep")))
+	case "Hover":
+		return nil, false, s.lspHover(action, pathInfo)
+	case "Rename":
+		return nil, false, s.lspRename(action, strings.TrimSpace(strings.TrimPrefix(action.Command, "Rename")))
+	case "Ls":
+		return nil, false, s.relistDirectory(action.ContentId(), pathInfo, strings.Fields(action.Command)[1:])
+	case "Get":
+		if len(pathInfo.path) == 0 {
 			return nil, false, nil
 		}
-		fileContent := s.Server.Content(action.ContentId())
-		if fileContent == nil {
-			return nil, false, fmt.Errorf("Cannot find file %d to save!", action.ContentId())
-		}
-		var data []byte
-		if fileContent != nil {
-			// Put command here ignores all embeds and just save texts to a file, later
-			// we can add a different command that do save embeds in the buffer
-			data = []byte(DeltaToString(fileContent.Delta, false))
-		}
-		var sourceFile *os.File
-		sourceFileStat, err := os.Stat(pathInfo.path)
-		if err != nil {
-			if !os.IsNotExist(err) {
-				return nil, false, err
-			}
-		}
-		if err == nil {
-			sourceFile, err = os.Open(pathInfo.path)
-			if err != nil {
-				return nil, false, err
-			}
-		}
-		if sourceFile == nil && pathInfo.partialLoad() {
-			return nil, false, fmt.Errorf("Partial loading requires a file that exists!")
-		}
-		savingFile, err := ioutil.TempFile(filepath.Dir(pathInfo.path), "saving")
-		if err != nil {
-			return nil, false, err
-		}
-		savingFilename := savingFile.Name()
-		if pathInfo.partialLoad() && *pathInfo.start > 0 {
-			_, err = io.CopyN(savingFile, sourceFile, *pathInfo.start)
-			if err != nil {
-				savingFile.Close()
-				os.Remove(savingFilename)
-				return nil, false, err
-			}
-		}
-		_, err = savingFile.Write(data)
-		if err != nil {
-			savingFile.Close()
-			os.Remove(savingFilename)
-			return nil, false, err
-		}
-		if pathInfo.partialLoad() && *pathInfo.start+*pathInfo.length < sourceFileStat.Size() {
-			remainingStart := *pathInfo.start + *pathInfo.length
-			_, err = sourceFile.Seek(remainingStart, os.SEEK_SET)
-			if err != nil {
-				savingFile.Close()
-				os.Remove(savingFilename)
-				return nil, false, err
-			}
-			_, err = io.CopyN(savingFile, sourceFile, sourceFileStat.Size()-remainingStart)
-			if err != nil {
-				savingFile.Close()
-				os.Remove(savingFilename)
-				return nil, false, err
-			}
-		}
-		err = savingFile.Close()
-		if err != nil {
-			return nil, false, err
+		return nil, false, s.reloadFile(action.ContentId(), pathInfo)
+	case "Put", "Put!":
+		if action.Id == MetaFileId || len(pathInfo.path) == 0 {
+			return nil, false, nil
 		}
-		err = os.Rename(savingFilename, pathInfo.path)
-		if err != nil {
-			return nil, false, err
+		return nil, false, s.putFile(action.ContentId(), pathInfo, commands[0] == "Put!")
+	case "Merge":
+		if len(pathInfo.path) == 0 {
+			return nil, false, nil
 		}
-		return nil, false, s.markClean(action.ContentId())
+		return nil, false, s.mergeFile(action.ContentId(), pathInfo)
 	default:
 		if strings.HasPrefix(action.Command, "Edit") {
 			s.editFile(action)
 			return nil, false, nil
 		}
-		cmds := strings.Split(strings.TrimSpace(action.Command), " ")
-		if len(cmds) > 0 && len(cmds[0]) > 0 {
-			firstChar := string(cmds[0][0])
+		command := strings.TrimSpace(action.Command)
+		if len(command) > 0 {
+			firstChar := command[:1]
 			pipeSelectionToStdin := firstChar == "|" || firstChar == ">"
 			pipeStdoutToSelection := firstChar == "|" || firstChar == "<"
 			if pipeSelectionToStdin || pipeStdoutToSelection {
-				cmds[0] = cmds[0][1:]
+				command = command[1:]
 			}
-			path, err := exec.LookPath(cmds[0])
-			if err == nil {
+			ctx := context.Background()
+			if pipeStdoutToSelection {
 				var cancelCmd context.CancelFunc
-				ctx := context.Background()
-				if pipeStdoutToSelection {
-					ctx, cancelCmd = context.WithTimeout(ctx, CommandTimeoutSeconds*time.Second)
-				}
-				cmd := exec.CommandContext(ctx, path, cmds[1:]...)
-				// acmeaddr is different from paguridae addr. acmeaddr describes the command
-				// argument sent via mouse chording, while paguridaesaddr describes the addr
-				// for selected texts passed in via pipes. Later if we decide to add mouse
-				// chording, we can then include acmeaddr here.
-				cmd.Env = append(os.Environ(),
-					fmt.Sprintf("winid=%d", action.Id),
-					fmt.Sprintf("%%=%s", pathInfo.path),
-					fmt.Sprintf("samfile=%s", pathInfo.path),
-					fmt.Sprintf("paguridae_session=%s", s.Id()),
-					fmt.Sprintf("paguridae_selection_id=%d", action.Selection.Id),
-					fmt.Sprintf("paguridae_selection_addr=#%d,#%d", action.Selection.Range.Index,
-						action.Selection.Range.Index+action.Selection.Range.Length))
-				if pipeSelectionToStdin {
-					d := s.Server.Content(action.Selection.Id).Delta.Slice(
-						int(action.Selection.Range.Index),
-						int(action.Selection.Range.Index+action.Selection.Range.Length))
-					cmd.Stdin = strings.NewReader(DeltaToString(*d, false))
-				}
-				labelId := action.LabelId()
-				w := s.newErrorBuffer(&labelId)
-				cmd.Stderr = w
-				var stdoutBuffer bytes.Buffer
-				if pipeStdoutToSelection {
-					cmd.Stdout = &stdoutBuffer
-				} else {
-					cmd.Stdout = w
-				}
-				err = cmd.Start()
+				ctx, cancelCmd = context.WithTimeout(ctx, CommandTimeoutSeconds*time.Second)
+				defer cancelCmd()
+			}
+			// Commands run through the shell, so quotes, pipes, redirects and
+			// globs all work as expected.
+			cmd := exec.Command(*shell, "-c", command)
+			cmd.Dir = windowDirectory(s.windowStorage(action.ContentId()), pathInfo)
+			// acmeaddr is different from paguridae addr. acmeaddr describes the command
+			// argument sent via mouse chording, while paguridaesaddr describes the addr
+			// for selected texts passed in via pipes. Later if we decide to add mouse
+			// chording, we can then include acmeaddr here.
+			cmd.Env = append(os.Environ(),
+				fmt.Sprintf("winid=%d", action.Id),
+				fmt.Sprintf("%%=%s", pathInfo.path),
+				fmt.Sprintf("samfile=%s", pathInfo.path),
+				fmt.Sprintf("paguridae_session=%s", s.Id()),
+				fmt.Sprintf("paguridae_selection_id=%d", action.Selection.Id),
+				fmt.Sprintf("paguridae_selection_addr=#%d,#%d", action.Selection.Range.Index,
+					action.Selection.Range.Index+action.Selection.Range.Length))
+			if pipeSelectionToStdin {
+				d := s.Server.Content(action.Selection.Id).Delta.Slice(
+					int(action.Selection.Range.Index),
+					int(action.Selection.Range.Index+action.Selection.Range.Length))
+				cmd.Stdin = strings.NewReader(DeltaToString(*d, false))
+			}
+			labelId := action.LabelId()
+			w := s.newErrorBuffer(&labelId)
+			cmd.Stderr = w
+			var stdoutBuffer bytes.Buffer
+			if pipeStdoutToSelection {
+				cmd.Stdout = &stdoutBuffer
+			} else {
+				cmd.Stdout = w
+			}
+			if !pipeStdoutToSelection {
+				// Commands might run forever, such as tail -f, so they
+				// are left running and reported once they exit
+				p, err := s.startProcess(cmd, action.Command, labelId)
 				if err != nil {
 					return nil, false, err
 				}
-				if pipeStdoutToSelection {
-					// Wait for command to finish first
-					err = cmd.Wait()
-					if err != nil {
-						return nil, false, err
-					}
-					cancelCmd()
-					// Grab stdout data and modify selection
-					oldContent := s.Server.Content(action.Selection.Id)
-					s.Server.Submit(nil, ot.ClientChange{
-						Id:   action.Selection.Id,
-						Base: oldContent.Version,
-						Delta: *delta.New(nil).
-							Retain(int(action.Selection.Range.Index), nil).
-							Delete(int(action.Selection.Range.Length)).
-							Insert(string(stdoutBuffer.String()), nil),
-					})
-				}
+				done := make(chan error, 1)
+				go func() {
+					done <- s.waitProcess(cmd, p, true)
+				}()
+				return nil, false, &runningCommand{done: done}
+			}
+			err := s.runProcess(ctx, cmd, action.Command, labelId, false)
+			if err != nil {
+				return nil, false, err
 			}
+			// Grab stdout data and modify selection
+			oldContent := s.Server.Content(action.Selection.Id)
+			s.Server.Submit(nil, ot.ClientChange{
+				Id:   action.Selection.Id,
+				Base: oldContent.Version,
+				Delta: *delta.New(nil).
+					Retain(int(action.Selection.Range.Index), nil).
+					Delete(int(action.Selection.Range.Length)).
+					Insert(string(stdoutBuffer.String()), nil),
+			})
 		}
 		return nil, false, nil
 	}
@@ -9,15 +9,17 @@ import (
 )
 
 type SessionManager struct {
-	sessions      map[uuid.UUID]*Session
-	mux           sync.Mutex
-	verifyContent bool
+	sessions        map[uuid.UUID]*Session
+	mux             sync.Mutex
+	verifyContent   bool
+	perClientLayout bool
 }
 
-func NewSessionManager(verifyContent bool, sessionPurgeSeconds int) *SessionManager {
+func NewSessionManager(verifyContent bool, perClientLayout bool, sessionPurgeSeconds int) *SessionManager {
 	m := &SessionManager{
-		sessions:      make(map[uuid.UUID]*Session),
-		verifyContent: verifyContent,
+		sessions:        make(map[uuid.UUID]*Session),
+		verifyContent:   verifyContent,
+		perClientLayout: perClientLayout,
 	}
 	go func() {
 		emptySessions := make(map[uuid.UUID]time.Time)
@@ -62,7 +64,7 @@ func (m *SessionManager) FindOrCreateSession(id *uuid.UUID) (*Session, error) {
 	}
 	if session == nil {
 		var err error
-		session, err = NewSession(m.verifyContent)
+		session, err = NewSession(m.verifyContent, m.perClientLayout)
 		if err != nil {
 			return nil, err
 		}
@@ -70,3 +72,15 @@ func (m *SessionManager) FindOrCreateSession(id *uuid.UUID) (*Session, error) {
 	}
 	return session, nil
 }
+
+func (m *SessionManager) ExitSession(id uuid.UUID) {
+	m.mux.Lock()
+	session, ok := m.sessions[id]
+	delete(m.sessions, id)
+	m.mux.Unlock()
+
+	if ok {
+		log.Printf("Exiting session: %s", id)
+		session.Exit()
+	}
+}
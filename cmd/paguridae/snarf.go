@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+	"xuejie.space/c/paguridae/pkg/ot"
+)
+
+// Snarf buffer is shared by everyone in a session, 9P clients can also
+// read or write it via the snarf file in root.
+func (s *Session) Snarf() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.snarfBuffer
+}
+
+func (s *Session) SetSnarf(text string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.snarfBuffer = text
+}
+
+// Selection is moved to current version of the file, so the text snarfed
+// and the range replaced are the same even with concurrent edits. Only the
+// current range is used, selections with multiple ranges are refused.
+func (s *Session) currentSelection(selection Selection) (Selection, delta.Delta, error) {
+	if len(selection.Ranges) > 1 {
+		return selection, delta.Delta{}, errors.New("Snarf, Cut and Paste only work on a single selection")
+	}
+	content := s.Server.Content(selection.Id)
+	if content == nil {
+		return selection, delta.Delta{}, fmt.Errorf("Cannot find file %d", selection.Id)
+	}
+	selection = s.TransformSelection(selection, content.Version)
+	if selection.Version != 0 && selection.Version != content.Version {
+		return selection, delta.Delta{}, fmt.Errorf("Selection of file %d cannot be moved to current version", selection.Id)
+	}
+	selection.Version = content.Version
+	return selection, content.Delta, nil
+}
+
+// Selection is replaced with text as a normal OT change against the version
+// of selection, concurrent edits are transformed by the OT server.
+func (s *Session) replaceSelection(selection Selection, text string) error {
+	s.Server.Submit(nil, ot.ClientChange{
+		Id:   selection.Id,
+		Base: selection.Version,
+		Delta: *delta.New(nil).
+			Retain(int(selection.Range.Index), nil).
+			Delete(int(selection.Range.Length)).
+			Insert(text, nil),
+	})
+	if selection.Id%2 == 0 && selection.Id != MetaFileId {
+		return s.contentChanged(selection.Id)
+	}
+	return nil
+}
+
+func (s *Session) snarf(selection Selection, cut bool) error {
+	selection, d, err := s.currentSelection(selection)
+	if err != nil {
+		return err
+	}
+	text := d.Slice(int(selection.Range.Index), int(selection.Range.Index+selection.Range.Length))
+	s.SetSnarf(DeltaToString(*text, false))
+	if cut && selection.Range.Length > 0 {
+		return s.replaceSelection(selection, "")
+	}
+	return nil
+}
+
+func (s *Session) paste(selection Selection) error {
+	selection, _, err := s.currentSelection(selection)
+	if err != nil {
+		return err
+	}
+	return s.replaceSelection(selection, s.Snarf())
+}
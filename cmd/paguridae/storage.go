@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+	"xuejie.space/c/go-quill-editor"
+)
+
+// Storage abstracts file access of windows. New windows use storage of the
+// session, which can be switched with the Storage command, while opened
+// windows keep the storage they are bound to. Paths are absolute.
+type Storage interface {
+	Stat(path string) (os.FileInfo, error)
+	// Entries are sorted by name, like ioutil.ReadDir.
+	ReadDir(path string) ([]os.FileInfo, error)
+	Open(path string) (StorageFile, error)
+	// Content of path is replaced atomically with data read from r.
+	WriteFile(path string, r io.Reader) error
+}
+
+type StorageFile interface {
+	io.ReadSeeker
+	io.ReaderAt
+	io.Closer
+}
+
+type LocalStorage struct{}
+
+func (LocalStorage) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (LocalStorage) ReadDir(path string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(path)
+}
+
+func (LocalStorage) Open(path string) (StorageFile, error) {
+	return os.Open(path)
+}
+
+func (LocalStorage) WriteFile(path string, r io.Reader) error {
+	savingFile, err := ioutil.TempFile(filepath.Dir(path), "saving")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(savingFile, r)
+	if err != nil {
+		savingFile.Close()
+		os.Remove(savingFile.Name())
+		return err
+	}
+	err = savingFile.Close()
+	if err != nil {
+		os.Remove(savingFile.Name())
+		return err
+	}
+	return os.Rename(savingFile.Name(), path)
+}
+
+type storageFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i storageFileInfo) Name() string       { return i.name }
+func (i storageFileInfo) Size() int64        { return i.size }
+func (i storageFileInfo) Mode() os.FileMode  { return i.mode }
+func (i storageFileInfo) ModTime() time.Time { return i.modTime }
+func (i storageFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i storageFileInfo) Sys() interface{}   { return nil }
+
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) Close() error { return nil }
+
+func notExist(op string, path string) error {
+	return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+}
+
+// Memory storage keeps files in a map, directories are implied by paths of
+// files in them.
+type MemoryStorage struct {
+	files map[string]storageFileInfo
+	data  map[string][]byte
+	mux   sync.Mutex
+}
+
+func NewMemoryStorage(files map[string]string) *MemoryStorage {
+	m := &MemoryStorage{
+		files: make(map[string]storageFileInfo),
+		data:  make(map[string][]byte),
+	}
+	for p, content := range files {
+		m.WriteFile(p, strings.NewReader(content))
+	}
+	return m
+}
+
+func (m *MemoryStorage) Stat(p string) (os.FileInfo, error) {
+	p = path.Clean(p)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if info, ok := m.files[p]; ok {
+		return info, nil
+	}
+	for file := range m.files {
+		if strings.HasPrefix(file, strings.TrimSuffix(p, "/")+"/") {
+			return storageFileInfo{name: path.Base(p), mode: os.ModeDir | 0755}, nil
+		}
+	}
+	return nil, notExist("stat", p)
+}
+
+func (m *MemoryStorage) ReadDir(p string) ([]os.FileInfo, error) {
+	prefix := strings.TrimSuffix(path.Clean(p), "/") + "/"
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	entries := make(map[string]os.FileInfo)
+	for file, info := range m.files {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		parts := strings.SplitN(file[len(prefix):], "/", 2)
+		if len(parts) == 1 {
+			entries[parts[0]] = info
+		} else {
+			entries[parts[0]] = storageFileInfo{name: parts[0], mode: os.ModeDir | 0755}
+		}
+	}
+	if len(entries) == 0 {
+		return nil, notExist("readdir", p)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, info := range entries {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *MemoryStorage) Open(p string) (StorageFile, error) {
+	p = path.Clean(p)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	data, ok := m.data[p]
+	if !ok {
+		return nil, notExist("open", p)
+	}
+	return bytesFile{bytes.NewReader(data)}, nil
+}
+
+func (m *MemoryStorage) WriteFile(p string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	p = path.Clean(p)
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.data[p] = data
+	m.files[p] = storageFileInfo{
+		name:    path.Base(p),
+		size:    int64(len(data)),
+		mode:    0644,
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// Git storage shows a tree-ish of the repository containing a directory
+// read-only, paths are still absolute paths inside the repository.
+type GitStorage struct {
+	root string
+	tree string
+}
+
+func NewGitStorage(dir string, treeish string) (*GitStorage, error) {
+	g := &GitStorage{root: dir}
+	root, err := g.git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	g.root = strings.TrimSpace(string(root))
+	tree, err := g.git("rev-parse", "--verify", treeish+"^{tree}")
+	if err != nil {
+		return nil, err
+	}
+	g.tree = strings.TrimSpace(string(tree))
+	return g, nil
+}
+
+func (g *GitStorage) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.root
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Relative path inside the repository, false when outside of it.
+func (g *GitStorage) relative(p string) (string, bool) {
+	rel, err := filepath.Rel(g.root, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// Parses "<mode> <type> <object> <size>\t<path>" lines of ls-tree -l.
+func (g *GitStorage) lsTree(rel string) ([]os.FileInfo, error) {
+	args := []string{"ls-tree", "-l", g.tree}
+	if rel != "." {
+		args = append(args, "--", rel)
+	}
+	output, err := g.git(args...)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]os.FileInfo, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		parts := strings.SplitN(line, "\t", 2)
+		fields := strings.Fields(parts[0])
+		if len(parts) != 2 || len(fields) != 4 {
+			continue
+		}
+		info := storageFileInfo{name: path.Base(parts[1]), mode: 0444}
+		if fields[1] == "tree" {
+			info.mode = os.ModeDir | 0555
+		} else {
+			info.size, _ = strconv.ParseInt(fields[3], 10, 64)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (g *GitStorage) Stat(p string) (os.FileInfo, error) {
+	rel, ok := g.relative(p)
+	if !ok {
+		return nil, notExist("stat", p)
+	}
+	if rel == "." {
+		return storageFileInfo{name: path.Base(g.root), mode: os.ModeDir | 0555}, nil
+	}
+	infos, err := g.lsTree(rel)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) != 1 {
+		return nil, notExist("stat", p)
+	}
+	return infos[0], nil
+}
+
+func (g *GitStorage) ReadDir(p string) ([]os.FileInfo, error) {
+	rel, ok := g.relative(p)
+	if !ok {
+		return nil, notExist("readdir", p)
+	}
+	if rel != "." {
+		rel += "/"
+	}
+	return g.lsTree(rel)
+}
+
+func (g *GitStorage) Open(p string) (StorageFile, error) {
+	rel, ok := g.relative(p)
+	if !ok {
+		return nil, notExist("open", p)
+	}
+	data, err := g.git("cat-file", "blob", g.tree+":"+rel)
+	if err != nil {
+		return nil, err
+	}
+	return bytesFile{bytes.NewReader(data)}, nil
+}
+
+func (g *GitStorage) WriteFile(p string, r io.Reader) error {
+	return errors.New("git storage is read-only")
+}
+
+func (s *Session) Storage() Storage {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.storage
+}
+
+func (s *Session) SetStorage(storage Storage) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.storage = storage
+}
+
+// Views sharing a content file share its storage.
+func (s *Session) windowStorage(contentId uint32) Storage {
+	bufferId := s.bufferId(contentId)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if storage, ok := s.storages[bufferId]; ok {
+		return storage
+	}
+	return s.storage
+}
+
+func (s *Session) bindStorage(contentId uint32, storage Storage) {
+	bufferId := s.bufferId(contentId)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.storages[bufferId] = storage
+}
+
+// Storage command switches storage of new windows: "Storage" or "Storage
+// local" uses local disk, "Storage memory" an empty in-memory storage, and
+// "Storage git <tree-ish>" the repository containing the window.
+func (s *Session) switchStorage(storage Storage, pathInfo fullPathInfo, args []string) error {
+	if len(args) == 0 || args[0] == "local" {
+		s.SetStorage(LocalStorage{})
+		return nil
+	}
+	switch args[0] {
+	case "memory":
+		s.SetStorage(NewMemoryStorage(nil))
+	case "git":
+		treeish := "HEAD"
+		if len(args) > 1 {
+			treeish = args[1]
+		}
+		gitStorage, err := NewGitStorage(windowDirectory(storage, pathInfo), treeish)
+		if err != nil {
+			return err
+		}
+		s.SetStorage(gitStorage)
+	default:
+		return fmt.Errorf("Unknown storage: %s", args[0])
+	}
+	return nil
+}
+
+// Sam commands run on local files directly, files of other storages are
+// loaded into memory first.
+func samFile(file StorageFile) (editor.File, error) {
+	if osFile, ok := file.(*os.File); ok {
+		return editor.NewGoFile(osFile), nil
+	}
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return editor.NewDeltaFile(*delta.New(nil).Insert(string(data), nil)), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+)
+
+func TestMemoryStorageStat(t *testing.T) {
+	m := NewMemoryStorage(map[string]string{"/a/b/c.txt": "hello"})
+	stat, err := m.Stat("/a/b/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Name() != "c.txt" || stat.Size() != 5 || stat.IsDir() {
+		t.Errorf("Unexpected file: %s %d %v", stat.Name(), stat.Size(), stat.IsDir())
+	}
+	for _, dir := range []string{"/a", "/a/b/", "/"} {
+		stat, err = m.Stat(dir)
+		if err != nil || !stat.IsDir() {
+			t.Errorf("%s is not a directory: %v", dir, err)
+		}
+	}
+	_, err = m.Stat("/a/b/d.txt")
+	if !os.IsNotExist(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestMemoryStorageReadDir(t *testing.T) {
+	m := NewMemoryStorage(map[string]string{
+		"/a/z.txt":     "z",
+		"/a/b/c.txt":   "c",
+		"/a/b/d/e.txt": "e",
+		"/ab.txt":      "ab",
+	})
+	infos, err := m.ReadDir("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+		if info.IsDir() {
+			names[i] += "/"
+		}
+	}
+	if strings.Join(names, " ") != "b/ z.txt" {
+		t.Errorf("Unexpected entries: %v", names)
+	}
+	_, err = m.ReadDir("/missing")
+	if !os.IsNotExist(err) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestMemoryStorageWriteFile(t *testing.T) {
+	m := NewMemoryStorage(nil)
+	for _, content := range []string{"first", "second version"} {
+		err := m.WriteFile("/x/y.txt", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := m.Open("/x/y.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil || string(data) != content {
+			t.Errorf("Unexpected content: %q %v", data, err)
+		}
+		stat, err := m.Stat("/x/y.txt")
+		if err != nil || stat.Size() != int64(len(content)) {
+			t.Errorf("Unexpected stat: %v %v", stat, err)
+		}
+	}
+}
+
+// Windows keep writing to the storage they are opened with, even after the
+// session switches to another one.
+func TestMemoryStoragePut(t *testing.T) {
+	s, err := NewSession(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	m := NewMemoryStorage(map[string]string{"/mem/a.txt": "hello\n"})
+	s.SetStorage(m)
+	pathInfo := parseFullPath("/mem/a.txt")
+	selection, _, err := s.FindOrOpenFile(pathInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := s.Server.Content(selection.Id)
+	if content == nil || DeltaToString(content.Delta, false) != "hello\n" {
+		t.Fatalf("Unexpected content: %v", content)
+	}
+	err = s.Server.Update(selection.Id, func(d delta.Delta) (delta.Delta, error) {
+		return *delta.New(nil).Retain(5, nil).Insert(", world", nil), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetStorage(LocalStorage{})
+	err = s.putFile(selection.Id, pathInfo, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := m.Open("/mem/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil || string(data) != "hello, world\n" {
+		t.Errorf("Unexpected saved content: %q %v", data, err)
+	}
+	changed, err := s.changedOnDisk(selection.Id, pathInfo)
+	if err != nil || changed {
+		t.Errorf("Saved file is reported as changed: %v", err)
+	}
+}
+
+func TestMemoryStorageProjectFiles(t *testing.T) {
+	m := NewMemoryStorage(map[string]string{
+		"/p/.gitignore":     "*.log\nbuild/\n",
+		"/p/.git/config":    "",
+		"/p/a.go":           "",
+		"/p/x.log":          "",
+		"/p/build/b.go":     "",
+		"/p/sub/.gitignore": "c.go\n",
+		"/p/sub/c.go":       "",
+		"/p/sub/d.go":       "",
+		"/p/other/c.go":     "",
+	})
+	files, err := projectFiles(m, "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, " ") != ".gitignore a.go other/c.go sub/.gitignore sub/d.go" {
+		t.Errorf("Unexpected files: %v", files)
+	}
+}
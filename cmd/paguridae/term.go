@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+)
+
+// Shell output is inserted with this attribute, so the output point, where
+// texts typed by users begin, is tracked within the content itself and
+// stays correct through concurrent edits. Input lines are given the same
+// attribute once sent to the shell. Clients simply ignore the attribute.
+const TermOutputAttribute = "term"
+
+const TermLabel = " | Del Intr Eof"
+
+// Terms are keyed by buffer ID like other states of content files, when
+// the view is deleted, the term moves to the next view of the content.
+type term struct {
+	master    *os.File
+	pid       int
+	contentId uint32
+}
+
+func termOutputPoint(d delta.Delta) int {
+	point, index := 0, 0
+	for _, op := range d.Ops {
+		if op.Insert != nil {
+			index += len(op.Insert)
+		} else if op.InsertEmbed != nil {
+			index++
+		}
+		if _, ok := op.Attributes[TermOutputAttribute]; ok {
+			point = index
+		}
+	}
+	return point
+}
+
+func termAttributes() map[string]interface{} {
+	return map[string]interface{}{TermOutputAttribute: true}
+}
+
+func (s *Session) findTerm(contentId uint32) *term {
+	bufferId := s.bufferId(contentId)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.terms[bufferId]
+}
+
+func (s *Session) termContentId(t *term) uint32 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return t.contentId
+}
+
+// Term creates a window bound to a shell running in a pty. Everyone
+// watching the window sees the same shell session.
+func (s *Session) createTerm(storage Storage, pathInfo fullPathInfo) error {
+	master, slave, err := openPty()
+	if err != nil {
+		return err
+	}
+	dir := windowDirectory(storage, pathInfo)
+	contentId, err := s.createFile(filepath.Join(dir, "+Term")+TermLabel, nil)
+	if err != nil {
+		master.Close()
+		slave.Close()
+		return err
+	}
+	cmd := exec.Command(*shell)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TERM=dumb")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	setSessionLeader(cmd)
+	p, err := s.startProcess(cmd, *shell, contentId-1)
+	slave.Close()
+	if err != nil {
+		master.Close()
+		return err
+	}
+	go s.waitProcess(cmd, p, true)
+	t := &term{
+		master:    master,
+		pid:       p.pid,
+		contentId: contentId,
+	}
+	s.mux.Lock()
+	s.terms[contentId] = t
+	s.mux.Unlock()
+	go s.readTerm(t)
+	return nil
+}
+
+func (s *Session) readTerm(t *term) {
+	defer func() {
+		s.closeTerm(s.termContentId(t))
+	}()
+	buf := make([]byte, 4096)
+	var pending []byte
+	for {
+		n, err := t.master.Read(buf)
+		if err != nil {
+			// Reading fails with EIO once the shell exits
+			return
+		}
+		data := append(pending, buf[:n]...)
+		// Incomplete UTF-8 sequences are kept till next read
+		cut := len(data)
+		for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:]) {
+					cut = i
+				}
+				break
+			}
+		}
+		output := string(data[:cut])
+		pending = append([]byte(nil), data[cut:]...)
+		// Writing fails when the view is deleted, then the next view is tried
+		contentId := uint32(0)
+		for contentId != s.termContentId(t) {
+			contentId = s.termContentId(t)
+			err = s.Server.UpdateUnrecorded(contentId, func(d delta.Delta) (delta.Delta, error) {
+				return *delta.New(nil).
+					Retain(termOutputPoint(d), nil).
+					Insert(output, termAttributes()), nil
+			})
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("Error writing term output: %v", err)
+			return
+		}
+	}
+}
+
+// Complete lines typed after the output point are sent to the shell.
+func (s *Session) termInput(contentId uint32, t *term) error {
+	var input string
+	err := s.Server.UpdateUnrecorded(contentId, func(d delta.Delta) (delta.Delta, error) {
+		point := termOutputPoint(d)
+		pending := DeltaToRunes(d, true)[point:]
+		end := 0
+		for i, r := range pending {
+			if r == '\n' {
+				end = i + 1
+			}
+		}
+		input = string(pending[:end])
+		return *delta.New(nil).
+			Retain(point, nil).
+			Retain(end, termAttributes()), nil
+	})
+	if err != nil || len(input) == 0 {
+		return err
+	}
+	_, err = t.master.Write([]byte(input))
+	return err
+}
+
+// Control characters are interpreted by the pty, which then signals the
+// foreground process group.
+func (s *Session) termControl(contentId uint32, command string) error {
+	t := s.findTerm(contentId)
+	if t == nil {
+		return fmt.Errorf("%s only works in Term windows", command)
+	}
+	var c byte
+	switch command {
+	case "Intr":
+		c = 0x03
+	case "Eof":
+		c = 0x04
+	}
+	_, err := t.master.Write([]byte{c})
+	return err
+}
+
+func (s *Session) closeTerm(contentId uint32) {
+	contentId = s.bufferId(contentId)
+	s.mux.Lock()
+	t := s.terms[contentId]
+	delete(s.terms, contentId)
+	s.mux.Unlock()
+	if t != nil {
+		hangupProcessGroup(t.pid)
+		t.master.Close()
+	}
+}
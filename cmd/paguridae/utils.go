@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/fmpwizard/go-quilljs-delta/delta"
 	"github.com/sergi/go-diff/diffmatchpatch"
 )
@@ -38,3 +40,75 @@ func Diff(old delta.Delta, new delta.Delta) *delta.Delta {
 	}
 	return result
 }
+
+// Like Diff, but only text of old is compared with text, embeds and
+// attributes of old are kept. Inserted text takes attributes of the text it
+// replaces, or of the text before it, like typing does.
+func DiffText(old delta.Delta, text string) *delta.Delta {
+	runes := make([]rune, 0)
+	indexes := make([]int, 0)
+	attributes := make([]map[string]interface{}, 0)
+	index := 0
+	for _, op := range old.Ops {
+		if op.Insert == nil {
+			index++
+			continue
+		}
+		for _, r := range op.Insert {
+			runes = append(runes, r)
+			indexes = append(indexes, index)
+			attributes = append(attributes, op.Attributes)
+			index++
+		}
+	}
+	result := delta.New(nil)
+	// Index in old, and position in text runes of old
+	index, position := 0, 0
+	var inherited map[string]interface{}
+	diffs := diffmatchpatch.New().DiffMainRunes(runes, []rune(text), false)
+	for _, diff := range diffs {
+		length := len([]rune(diff.Text))
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			position += length
+			inherited = nil
+		case diffmatchpatch.DiffDelete:
+			inherited = attributes[position]
+			for i := 0; i < length; i++ {
+				if indexes[position] > index {
+					result.Retain(indexes[position]-index, nil)
+				}
+				result.Delete(1)
+				index = indexes[position] + 1
+				position++
+			}
+		case diffmatchpatch.DiffInsert:
+			to := 0
+			if position > 0 {
+				to = indexes[position-1] + 1
+				if inherited == nil {
+					inherited = attributes[position-1]
+				}
+			}
+			if to > index {
+				result.Retain(to-index, nil)
+				index = to
+			}
+			result.Insert(diff.Text, inherited)
+		}
+	}
+	return result
+}
+
+// Commands per file extension are configured as ";" separated
+// "<extension>=<command>" pairs, such as ".go=gopls;.rs=rust-analyzer".
+func parseExtensionCommands(config string) map[string]string {
+	commands := make(map[string]string)
+	for _, entry := range strings.Split(config, ";") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) == 2 && len(strings.TrimSpace(parts[1])) > 0 {
+			commands[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return commands
+}
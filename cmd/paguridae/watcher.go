@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// A conflicted window is dirty while its file also changes on disk, the
+// label would have "|*!" instead of "|*".
+const ConflictMarkCommand = `1s/\|\*?!?/|*!/`
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statStamp(storage Storage, path string) (fileStamp, error) {
+	stat, err := storage.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{
+		modTime: stat.ModTime(),
+		size:    stat.Size(),
+	}, nil
+}
+
+func (f fileStamp) same(other fileStamp) bool {
+	return f.modTime.Equal(other.modTime) && f.size == other.size
+}
+
+// Polling is used instead of inotify so the watcher works everywhere the
+// static binary runs. Clean windows are reloaded automatically when their
+// paths change on disk, dirty windows are marked as conflicted instead,
+// each change is only reported once.
+func (s *Session) watchFiles(interval time.Duration) {
+	conflicts := make(map[uint32]fileStamp)
+	for {
+		select {
+		case <-s.watcherSignal:
+			return
+		case <-time.After(interval):
+		}
+		newConflicts := make(map[uint32]fileStamp)
+		for _, change := range s.Server.AllContents() {
+			if change.Id == MetaFileId || change.Id%2 == 0 {
+				continue
+			}
+			labelId := change.Id
+			pathInfo := extractPath(change.Delta)
+			if len(pathInfo.path) == 0 {
+				continue
+			}
+			stamp, err := statStamp(s.windowStorage(labelId+1), pathInfo.path)
+			if err != nil {
+				continue
+			}
+			if oldStamp, ok := conflicts[labelId]; ok && oldStamp.same(stamp) {
+				newConflicts[labelId] = stamp
+				continue
+			}
+			changed, err := s.changedOnDisk(labelId+1, pathInfo)
+			if err != nil || !changed {
+				continue
+			}
+			if isDirtyLabel(DeltaToString(change.Delta, false)) {
+				newConflicts[labelId] = stamp
+				err = s.runSamCommand(labelId, ConflictMarkCommand)
+				fmt.Fprintf(s.newErrorBuffer(&labelId),
+					"%s changed on disk while having unsaved changes, use Get to reload, Merge to merge changes or Put! to overwrite\n",
+					pathInfo.path)
+			} else {
+				err = s.reloadFile(labelId+1, pathInfo)
+			}
+			if err != nil {
+				log.Printf("Error processing changed file %s: %v", pathInfo.path, err)
+			}
+		}
+		conflicts = newConflicts
+	}
+}
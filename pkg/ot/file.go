@@ -7,9 +7,12 @@ import (
 	"github.com/google/uuid"
 )
 
+// File ID is the ID a change is submitted through, which differs from the
+// file's own ID for changes made via aliases.
 type deltaWithClient struct {
 	d        delta.Delta
 	clientId *uuid.UUID
+	fileId   uint32
 }
 
 type File struct {
@@ -21,8 +24,12 @@ type File struct {
 	// * Provide revert function
 	// * Keep old versions of the document for slow clients
 	reverts []deltaWithClient
-	undos   uint32
-	redos   uint32
+	// Undo and redo stacks, each delta applies to the content left by
+	// applying the ones above it.
+	undos []delta.Delta
+	redos []delta.Delta
+	// Other IDs sharing this file
+	aliases map[uint32]bool
 }
 
 func NewFile(id uint32, d delta.Delta) *File {
@@ -31,6 +38,7 @@ func NewFile(id uint32, d delta.Delta) *File {
 		d:       d,
 		version: 1,
 		reverts: make([]deltaWithClient, 0),
+		aliases: make(map[uint32]bool),
 	}
 }
 
@@ -43,13 +51,16 @@ func (f *File) Content() ServerUpdate {
 	}
 }
 
-func sameClientId(clientId *uuid.UUID, data deltaWithClient) bool {
-	return clientId != nil && data.clientId != nil && *clientId == *data.clientId
+// Changes made by a client through an alias are not applied to the client's
+// copy of other IDs, so they are only skipped for the same file ID.
+func sameClientId(clientId *uuid.UUID, fileId uint32, data deltaWithClient) bool {
+	return clientId != nil && data.clientId != nil && *clientId == *data.clientId &&
+		fileId == data.fileId
 }
 
 // This function would assume all changes submitted by the specified client has
 // been applied, and send an update only contains changes from other users.
-func (f *File) UpdateSince(clientId *uuid.UUID, base uint32) ServerUpdate {
+func (f *File) UpdateSince(clientId *uuid.UUID, fileId uint32, base uint32) ServerUpdate {
 	if base == 0 {
 		return f.Content()
 	}
@@ -58,11 +69,11 @@ func (f *File) UpdateSince(clientId *uuid.UUID, base uint32) ServerUpdate {
 		// Return full content when requested version is too old to track.
 		return f.Content()
 	}
-	// TODO: unit test this, then optimize this
+	// TODO: optimize this
 	allChanges := delta.New(nil)
 	clientChanges := delta.New(nil)
 	for _, opData := range operations {
-		if sameClientId(clientId, opData) {
+		if sameClientId(clientId, fileId, opData) {
 			d := allChanges.Transform(opData.d, false)
 			d = clientChanges.Transform(*d, true)
 			clientChanges = clientChanges.Compose(*d)
@@ -80,52 +91,39 @@ func (f *File) UpdateSince(clientId *uuid.UUID, base uint32) ServerUpdate {
 	}
 }
 
+// Undone changes are kept for Redo until a new change is recorded.
 func (f *File) Undo() error {
-	undos, redos := f.undos, f.redos
-	// If the last action performed is a redo, a new undo session will be started.
-	// This is different from acme, and we might or might not revisit this later,
-	// but for now, we will opt for the simple solution.
-	if redos > 0 {
-		undos, redos = 0, 0
-	}
-	skipItems := redos + undos*2
-	if skipItems >= uint32(len(f.reverts)) {
+	if len(f.undos) == 0 {
 		return fmt.Errorf("Running out of changes to undo!")
 	}
-	data := f.reverts[uint32(len(f.reverts))-1-skipItems]
-	change := ClientChange{
-		Id:    f.id,
-		Delta: data.d,
-		Base:  f.version,
-	}
-	_, err := f.Submit(nil, change)
-	if err != nil {
-		return err
-	}
-	f.undos, f.redos = undos+1, redos
+	d := f.undos[len(f.undos)-1]
+	f.undos = f.undos[:len(f.undos)-1]
+	f.redos = append(f.redos, f.apply(nil, f.id, d))
 	return nil
 }
 
 func (f *File) Redo() error {
-	if f.redos >= f.undos {
+	if len(f.redos) == 0 {
 		return fmt.Errorf("Running out of undos!")
 	}
-	data := f.reverts[uint32(len(f.reverts))-1-f.redos]
-	change := ClientChange{
-		Id:    f.id,
-		Delta: data.d,
-		Base:  f.version,
-	}
-	_, err := f.Submit(nil, change)
-	if err != nil {
-		return err
-	}
-	f.redos += 1
+	d := f.redos[len(f.redos)-1]
+	f.redos = f.redos[:len(f.redos)-1]
+	f.undos = append(f.undos, f.apply(nil, f.id, d))
 	return nil
 }
 
 func (f *File) Submit(clientId *uuid.UUID, change ClientChange) (ServerUpdate, error) {
-	if change.Id != f.id {
+	return f.submit(clientId, change, true)
+}
+
+// Changes made by the server itself, such as highlighting, are not recorded
+// for undo, pending undos and redos are rebased on them instead.
+func (f *File) SubmitUnrecorded(change ClientChange) (ServerUpdate, error) {
+	return f.submit(nil, change, false)
+}
+
+func (f *File) submit(clientId *uuid.UUID, change ClientChange, record bool) (ServerUpdate, error) {
+	if change.Id != f.id && !f.aliases[change.Id] {
 		return ServerUpdate{}, fmt.Errorf("File ID does not match!")
 	}
 	if change.Base > f.version {
@@ -139,16 +137,15 @@ func (f *File) Submit(clientId *uuid.UUID, change ClientChange) (ServerUpdate, e
 		change.Delta = *operation.Transform(change.Delta, true)
 		change.Base = f.version
 	}
-	revert := *change.Delta.Invert(&f.d)
-	f.d = *f.d.Compose(change.Delta)
-	f.version += 1
-	f.reverts = append(f.reverts, deltaWithClient{
-		d:        revert,
-		clientId: clientId,
-	})
-
-	// New change will reset undo/redo session.
-	f.undos, f.redos = 0, 0
+	revert := f.apply(clientId, change.Id, change.Delta)
+	if record {
+		// New change will reset redos.
+		f.undos = append(f.undos, revert)
+		f.redos = nil
+	} else {
+		f.undos = rebase(f.undos, change.Delta)
+		f.redos = rebase(f.redos, change.Delta)
+	}
 	return ServerUpdate{
 		Id:      f.id,
 		Delta:   change.Delta,
@@ -157,6 +154,80 @@ func (f *File) Submit(clientId *uuid.UUID, change ClientChange) (ServerUpdate, e
 	}, nil
 }
 
+// Apply a change to current content, the revert of the change is returned.
+func (f *File) apply(clientId *uuid.UUID, fileId uint32, d delta.Delta) delta.Delta {
+	revert := *d.Invert(&f.d)
+	f.d = *f.d.Compose(d)
+	f.version += 1
+	f.reverts = append(f.reverts, deltaWithClient{
+		d:        revert,
+		clientId: clientId,
+		fileId:   fileId,
+	})
+	return revert
+}
+
+// Rebase a stack of deltas on d, which is applied to the content the top of
+// the stack applies to.
+func rebase(stack []delta.Delta, d delta.Delta) []delta.Delta {
+	rebased := make([]delta.Delta, len(stack))
+	for i := len(stack) - 1; i >= 0; i-- {
+		rebased[i] = *d.Transform(stack[i], true)
+		d = *stack[i].Transform(d, false)
+	}
+	return rebased
+}
+
+// Transform indexes computed against version base, so they point to the
+// same places in version target.
+func (f *File) TransformIndexes(base uint32, target uint32, indexes []int) ([]int, error) {
+	if target < base || target > f.version {
+		return nil, fmt.Errorf("Invalid transform from version %d to %d, current version: %d", base, target, f.version)
+	}
+	deltas, _, err := f.deltasSince(base)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]int, len(indexes))
+	copy(results, indexes)
+	for _, deltaData := range deltas[:target-base] {
+		for i := range results {
+			results[i] = TransformIndex(deltaData.d, results[i])
+		}
+	}
+	return results, nil
+}
+
+// This follows transformPosition from quill-delta, inserts happening right at
+// index will push the index forward.
+func TransformIndex(d delta.Delta, index int) int {
+	offset := 0
+	for _, op := range d.Ops {
+		if offset > index {
+			break
+		}
+		if op.Delete != nil {
+			if *op.Delete < index-offset {
+				index -= *op.Delete
+			} else {
+				index = offset
+			}
+			continue
+		}
+		length := 1
+		if op.Retain != nil {
+			length = *op.Retain
+		} else if op.Insert != nil {
+			length = len(op.Insert)
+		}
+		if op.Retain == nil {
+			index += length
+		}
+		offset += length
+	}
+	return index
+}
+
 func (f *File) deltasSince(base uint32) ([]deltaWithClient, *delta.Delta, error) {
 	revertedVersions := int(f.version - base)
 	if revertedVersions < 0 || revertedVersions > len(f.reverts) {
@@ -168,6 +239,7 @@ func (f *File) deltasSince(base uint32) ([]deltaWithClient, *delta.Delta, error)
 		revertedData := f.reverts[len(f.reverts)-1-i]
 		deltas[revertedVersions-1-i] = deltaWithClient{
 			clientId: revertedData.clientId,
+			fileId:   revertedData.fileId,
 			d:        *revertedData.d.Invert(&content),
 		}
 		content = *content.Compose(revertedData.d)
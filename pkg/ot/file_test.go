@@ -0,0 +1,177 @@
+package ot
+
+import (
+	"testing"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+	"github.com/google/uuid"
+)
+
+func submit(t *testing.T, f *File, clientId *uuid.UUID, d *delta.Delta) {
+	t.Helper()
+	_, err := f.Submit(clientId, ClientChange{Id: f.id, Base: f.version, Delta: *d})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func text(d delta.Delta) string {
+	runes := make([]rune, 0)
+	for _, op := range d.Ops {
+		runes = append(runes, op.Insert...)
+	}
+	return string(runes)
+}
+
+func TestTransformIndex(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		d        *delta.Delta
+		index    int
+		expected int
+	}{
+		{"insert before", delta.New(nil).Retain(1, nil).Insert("ab", nil), 3, 5},
+		{"insert at index", delta.New(nil).Retain(3, nil).Insert("ab", nil), 3, 5},
+		{"insert after", delta.New(nil).Retain(4, nil).Insert("ab", nil), 3, 3},
+		{"delete before", delta.New(nil).Retain(1, nil).Delete(1), 3, 2},
+		{"delete ending at index", delta.New(nil).Retain(1, nil).Delete(2), 3, 1},
+		{"delete starting at index", delta.New(nil).Retain(3, nil).Delete(2), 3, 3},
+		{"delete spanning index", delta.New(nil).Retain(2, nil).Delete(3), 3, 2},
+		{"replace spanning index", delta.New(nil).Retain(2, nil).Delete(3).Insert("xy", nil), 3, 4},
+		{"retain only", delta.New(nil).Retain(5, map[string]interface{}{"color": "red"}), 3, 3},
+	} {
+		if index := TransformIndex(*c.d, c.index); index != c.expected {
+			t.Errorf("%s: index %d is transformed to %d, expected %d", c.name, c.index, index, c.expected)
+		}
+	}
+}
+
+func TestTransformIndexes(t *testing.T) {
+	f := NewFile(1, *delta.New(nil).Insert("hello world", nil))
+	submit(t, f, nil, delta.New(nil).Insert(">> ", nil))
+	submit(t, f, nil, delta.New(nil).Retain(3, nil).Delete(6))
+	submit(t, f, nil, delta.New(nil).Retain(8, nil).Insert("!", nil))
+	if text(f.d) != ">> world!" {
+		t.Fatalf("Unexpected content: %q", text(f.d))
+	}
+	for _, c := range []struct {
+		base     uint32
+		target   uint32
+		indexes  []int
+		expected []int
+	}{
+		{1, 4, []int{0, 2, 6, 11}, []int{3, 3, 3, 9}},
+		{1, 2, []int{0, 2, 6, 11}, []int{3, 5, 9, 14}},
+		{2, 4, []int{3, 9, 14}, []int{3, 3, 9}},
+		{4, 4, []int{1, 5}, []int{1, 5}},
+	} {
+		indexes, err := f.TransformIndexes(c.base, c.target, c.indexes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range indexes {
+			if indexes[i] != c.expected[i] {
+				t.Errorf("From version %d to %d, %v are transformed to %v, expected %v",
+					c.base, c.target, c.indexes, indexes, c.expected)
+				break
+			}
+		}
+	}
+	for _, versions := range [][2]uint32{{3, 2}, {1, 5}} {
+		_, err := f.TransformIndexes(versions[0], versions[1], []int{0})
+		if err == nil {
+			t.Errorf("Transform from version %d to %d is accepted", versions[0], versions[1])
+		}
+	}
+}
+
+// Clients already applied their own changes, so updates only carry changes
+// of others.
+func TestUpdateSince(t *testing.T) {
+	a, b := uuid.New(), uuid.New()
+	f := NewFile(1, *delta.New(nil).Insert("abc", nil))
+	submit(t, f, &a, delta.New(nil).Retain(3, nil).Insert("X", nil))
+	submit(t, f, &a, delta.New(nil).Retain(1, nil).Delete(1))
+	submit(t, f, &b, delta.New(nil).Insert("Y", nil))
+	for _, c := range []struct {
+		clientId *uuid.UUID
+		content  string
+	}{
+		{&a, "acX"},
+		{&b, "Yabc"},
+		{nil, "abc"},
+	} {
+		update := f.UpdateSince(c.clientId, 1, 1)
+		result := text(*delta.New(nil).Insert(c.content, nil).Compose(update.Delta))
+		if result != "YacX" || update.Version != 4 {
+			t.Errorf("Update of %q is %q at version %d", c.content, result, update.Version)
+		}
+	}
+}
+
+func submitUnrecorded(t *testing.T, f *File, d *delta.Delta) {
+	t.Helper()
+	_, err := f.SubmitUnrecorded(ClientChange{Id: f.id, Base: f.version, Delta: *d})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Unrecorded changes, such as pages loaded or highlighting, stay in place
+// when recorded changes around them are undone or redone.
+func TestUndoUnrecorded(t *testing.T) {
+	f := NewFile(1, *delta.New(nil).Insert("abc", nil))
+	submit(t, f, nil, delta.New(nil).Retain(3, nil).Insert("X", nil))
+	submit(t, f, nil, delta.New(nil).Insert("Y", nil))
+	submitUnrecorded(t, f, delta.New(nil).Insert("PAGE", nil))
+	submitUnrecorded(t, f, delta.New(nil).Retain(9, nil).Insert("END", nil))
+	submitUnrecorded(t, f, delta.New(nil).Retain(2, map[string]interface{}{"color": "red"}))
+	if text(f.d) != "PAGEYabcXEND" {
+		t.Fatalf("Unexpected content: %q", text(f.d))
+	}
+	steps := []struct {
+		name    string
+		run     func() error
+		content string
+	}{
+		{"undo Y", f.Undo, "PAGEabcXEND"},
+		{"undo X", f.Undo, "PAGEabcEND"},
+		{"redo X", f.Redo, "PAGEabcXEND"},
+		{"drop page", func() error {
+			_, err := f.SubmitUnrecorded(ClientChange{Id: 1, Base: f.version, Delta: *delta.New(nil).Delete(4)})
+			return err
+		}, "abcXEND"},
+		{"redo Y", f.Redo, "YabcXEND"},
+		{"undo Y again", f.Undo, "abcXEND"},
+		{"undo X again", f.Undo, "abcEND"},
+	}
+	for _, step := range steps {
+		err := step.run()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if text(f.d) != step.content {
+			t.Fatalf("%s: content is %q, expected %q", step.name, text(f.d), step.content)
+		}
+	}
+	if f.Undo() == nil {
+		t.Error("Unrecorded changes are undone")
+	}
+}
+
+// A recorded change clears redos, even when unrecorded changes follow undos.
+func TestRedoClearedByRecordedChange(t *testing.T) {
+	f := NewFile(1, *delta.New(nil).Insert("abc", nil))
+	submit(t, f, nil, delta.New(nil).Insert("X", nil))
+	if err := f.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	submitUnrecorded(t, f, delta.New(nil).Retain(3, nil).Insert("!", nil))
+	submit(t, f, nil, delta.New(nil).Insert("Z", nil))
+	if f.Redo() == nil {
+		t.Error("Redo still works after a recorded change")
+	}
+	if err := f.Undo(); err != nil || text(f.d) != "abc!" {
+		t.Errorf("Unexpected content after undo: %q %v", text(f.d), err)
+	}
+}
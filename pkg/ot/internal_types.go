@@ -21,6 +21,8 @@ const (
 	typeBroadcast   = 11
 	typeUndo        = 12
 	typeRedo        = 13
+	typeTransform   = 14
+	typeAliases     = 15
 )
 
 type command struct {
@@ -28,6 +30,7 @@ type command struct {
 	clientId      *uuid.UUID
 	events        chan Event
 	contents      []delta.Delta
+	aliases       []uint32
 	fileIds       []uint32
 	fileId        uint32
 	changes       []ClientChange
@@ -35,8 +38,18 @@ type command struct {
 	updates       chan []ServerUpdate
 	fileIdChan    chan []uint32
 	updateFunc    UpdateFunction
+	unrecorded    bool
 	updateAllFunc UpdateAllFunction
 	errorChan     chan error
+	base          uint32
+	target        uint32
+	indexes       []int
+	transformChan chan transformResult
+}
+
+type transformResult struct {
+	indexes []int
+	err     error
 }
 
 // Client data structure in a server's view
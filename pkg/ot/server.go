@@ -2,6 +2,7 @@ package ot
 
 import (
 	"fmt"
+	"sort"
 	"sync/atomic"
 	"time"
 
@@ -90,6 +91,35 @@ func (s *Server) CreateFiles(contents ...delta.Delta) []uint32 {
 	return <-c
 }
 
+// Like CreateFiles, except that a non-zero alias makes the new ID share the
+// file of that ID instead of creating one from content. Content, versions
+// and undo history are all shared, the file is released when its last ID
+// is closed.
+func (s *Server) CreateAliasedFiles(contents []delta.Delta, aliases []uint32) []uint32 {
+	c := make(chan []uint32)
+
+	s.commands <- command{
+		t:          typeCreateFiles,
+		contents:   contents,
+		aliases:    aliases,
+		fileIdChan: c,
+	}
+	return <-c
+}
+
+// IDs sharing the same file as fileId, including fileId itself, in
+// ascending order.
+func (s *Server) Aliases(fileId uint32) []uint32 {
+	c := make(chan []uint32)
+
+	s.commands <- command{
+		t:          typeAliases,
+		fileId:     fileId,
+		fileIdChan: c,
+	}
+	return <-c
+}
+
 func (s *Server) CloseFiles(fileIds ...uint32) {
 	s.commands <- command{
 		t:       typeCloseFiles,
@@ -178,6 +208,23 @@ func (s *Server) Update(fileId uint32, f UpdateFunction) error {
 	return <-c
 }
 
+// Like Update, but the change is not recorded for undo, which suits changes
+// made by the server itself, such as highlighting or loading more content.
+// Empty changes are skipped, so no new version is created for them.
+func (s *Server) UpdateUnrecorded(fileId uint32, f UpdateFunction) error {
+	c := make(chan error)
+
+	s.commands <- command{
+		t:          typeUpdate,
+		fileId:     fileId,
+		updateFunc: f,
+		unrecorded: true,
+		errorChan:  c,
+	}
+
+	return <-c
+}
+
 func (s *Server) UpdateAll(f UpdateAllFunction) error {
 	c := make(chan error)
 
@@ -190,6 +237,22 @@ func (s *Server) UpdateAll(f UpdateAllFunction) error {
 	return <-c
 }
 
+func (s *Server) TransformIndexes(fileId uint32, base uint32, target uint32, indexes []int) ([]int, error) {
+	c := make(chan transformResult)
+
+	s.commands <- command{
+		t:             typeTransform,
+		fileId:        fileId,
+		base:          base,
+		target:        target,
+		indexes:       indexes,
+		transformChan: c,
+	}
+
+	result := <-c
+	return result.indexes, result.err
+}
+
 func (s *Server) Append(fileId uint32, text []rune) {
 	s.Update(fileId, func(d delta.Delta) (delta.Delta, error) {
 		return *delta.New(nil).Retain(d.Length(), nil).Insert(string(text), nil), nil
@@ -252,8 +315,8 @@ func (s *Server) Start() {
 					ConnectedClientId: &clientId,
 				}
 				event := Event{}
-				for _, file := range s.files {
-					event.Updates = append(event.Updates, file.Content())
+				for fileId, file := range s.files {
+					event.Updates = append(event.Updates, contentOf(fileId, file))
 				}
 				c.events <- event
 			case typeDisconnect:
@@ -266,8 +329,18 @@ func (s *Server) Start() {
 					}
 				}
 			case typeCreateFiles:
-				firstId, err := s.allocateFileIds(uint32(len(command.contents)))
+				var err error
+				for _, alias := range command.aliases {
+					if _, ok := s.files[alias]; alias != 0 && !ok {
+						err = fmt.Errorf("Cannot find file %d to alias!", alias)
+					}
+				}
+				var firstId uint32
+				if err == nil {
+					firstId, err = s.allocateFileIds(uint32(len(command.contents)))
+				}
 				if err != nil {
+					command.fileIdChan <- []uint32{}
 					if s.ErrorProcessor != nil {
 						s.ErrorProcessor(err)
 					}
@@ -276,7 +349,13 @@ func (s *Server) Start() {
 				fileIds := make([]uint32, len(command.contents))
 				for i := 0; i < len(command.contents); i++ {
 					fileId := firstId + uint32(i)
-					s.files[fileId] = NewFile(fileId, command.contents[i])
+					if i < len(command.aliases) && command.aliases[i] != 0 {
+						file := s.files[command.aliases[i]]
+						file.aliases[fileId] = true
+						s.files[fileId] = file
+					} else {
+						s.files[fileId] = NewFile(fileId, command.contents[i])
+					}
 					fileIds[i] = fileId
 				}
 				command.fileIdChan <- fileIds
@@ -303,6 +382,7 @@ func (s *Server) Start() {
 				event := Event{}
 				for _, fileId := range command.fileIds {
 					event.ClosedFileIds = append(event.ClosedFileIds, fileId)
+					delete(s.files[fileId].aliases, fileId)
 					delete(s.files, fileId)
 					for _, c := range s.clients {
 						delete(c.acks, fileId)
@@ -314,14 +394,14 @@ func (s *Server) Start() {
 				}
 			case typeContent:
 				if file, ok := s.files[command.fileId]; ok {
-					command.updates <- []ServerUpdate{file.Content()}
+					command.updates <- []ServerUpdate{contentOf(command.fileId, file)}
 				} else {
 					command.updates <- []ServerUpdate{}
 				}
 			case typeAllContents:
 				contents := make([]ServerUpdate, 0)
-				for _, file := range s.files {
-					contents = append(contents, file.Content())
+				for fileId, file := range s.files {
+					contents = append(contents, contentOf(fileId, file))
 				}
 				command.updates <- contents
 			case typeSubmit:
@@ -363,17 +443,26 @@ func (s *Server) Start() {
 				}
 			case typeUpdate:
 				if file, ok := s.files[command.fileId]; ok {
-					content := file.Content()
+					content := contentOf(command.fileId, file)
 					d, err := command.updateFunc(content.Delta)
 					if err != nil {
 						command.errorChan <- err
 						break
 					}
-					_, err = file.Submit(nil, ClientChange{
+					if command.unrecorded && len(d.Ops) == 0 {
+						command.errorChan <- nil
+						break
+					}
+					change := ClientChange{
 						Id:    content.Id,
 						Base:  content.Version,
 						Delta: d,
-					})
+					}
+					if command.unrecorded {
+						_, err = file.SubmitUnrecorded(change)
+					} else {
+						_, err = file.Submit(nil, change)
+					}
 					command.errorChan <- err
 					if err == nil {
 						s.broadcast()
@@ -383,8 +472,8 @@ func (s *Server) Start() {
 				}
 			case typeUpdateAll:
 				contents := make([]ServerUpdate, 0)
-				for _, file := range s.files {
-					contents = append(contents, file.Content())
+				for fileId, file := range s.files {
+					contents = append(contents, contentOf(fileId, file))
 				}
 				changes, err := command.updateAllFunc(contents)
 				if err != nil {
@@ -405,6 +494,17 @@ func (s *Server) Start() {
 				}
 			case typeBroadcast:
 				s.broadcast()
+			case typeAliases:
+				fileIds := make([]uint32, 0)
+				if file, ok := s.files[command.fileId]; ok {
+					for fileId, f := range s.files {
+						if f == file {
+							fileIds = append(fileIds, fileId)
+						}
+					}
+					sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+				}
+				command.fileIdChan <- fileIds
 			case typeUndo:
 				if file, ok := s.files[command.fileId]; ok {
 					err := file.Undo()
@@ -417,6 +517,18 @@ func (s *Server) Start() {
 				} else {
 					command.errorChan <- fmt.Errorf("Cannot find file %d", command.fileId)
 				}
+			case typeTransform:
+				if file, ok := s.files[command.fileId]; ok {
+					indexes, err := file.TransformIndexes(command.base, command.target, command.indexes)
+					command.transformChan <- transformResult{
+						indexes: indexes,
+						err:     err,
+					}
+				} else {
+					command.transformChan <- transformResult{
+						err: fmt.Errorf("Cannot find file %d", command.fileId),
+					}
+				}
 			case typeRedo:
 				if file, ok := s.files[command.fileId]; ok {
 					err := file.Redo()
@@ -474,11 +586,19 @@ func (s *Server) allocateFileIds(num uint32) (uint32, error) {
 	return 0, fmt.Errorf("Cannot allocate new file ID!")
 }
 
+// Content of a file as seen through fileId, which might be an alias.
+func contentOf(fileId uint32, file *File) ServerUpdate {
+	content := file.Content()
+	content.Id = fileId
+	return content
+}
+
 func (s *Server) broadcast() {
 	for clientId, c := range s.clients {
 		event := Event{}
 		for fileId, file := range s.files {
-			change := file.UpdateSince(&clientId, c.acks[fileId])
+			change := file.UpdateSince(&clientId, fileId, c.acks[fileId])
+			change.Id = fileId
 			last := c.last[fileId]
 			// TODO: we should also check last, when last is updated(it really is
 			// server ack to the client), we should also broadcast the state.
@@ -0,0 +1,111 @@
+package ot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fmpwizard/go-quilljs-delta/delta"
+)
+
+// Alias 0 means no alias, so file 0 is taken first, like the meta file of
+// sessions.
+func startServer(t *testing.T) *Server {
+	s := NewServer()
+	go s.Start()
+	t.Cleanup(s.Stop)
+	s.CreateFiles(delta.Delta{})
+	return s
+}
+
+func contentText(t *testing.T, s *Server, fileId uint32) string {
+	t.Helper()
+	content := s.Content(fileId)
+	if content == nil {
+		t.Fatalf("Cannot find file %d", fileId)
+	}
+	return text(content.Delta)
+}
+
+func TestAliasedFiles(t *testing.T) {
+	s := startServer(t)
+	original := s.CreateFiles(*delta.New(nil).Insert("hello", nil))[0]
+	ids := s.CreateAliasedFiles([]delta.Delta{{}, *delta.New(nil).Insert("other", nil)}, []uint32{original, 0})
+	if len(ids) != 2 {
+		t.Fatalf("Unexpected IDs: %v", ids)
+	}
+	alias, other := ids[0], ids[1]
+	for _, fileId := range []uint32{original, alias} {
+		if aliases := s.Aliases(fileId); !reflect.DeepEqual(aliases, []uint32{original, alias}) {
+			t.Errorf("Unexpected aliases of %d: %v", fileId, aliases)
+		}
+	}
+	if aliases := s.Aliases(other); !reflect.DeepEqual(aliases, []uint32{other}) {
+		t.Errorf("Unexpected aliases of %d: %v", other, aliases)
+	}
+	err := s.Update(alias, func(d delta.Delta) (delta.Delta, error) {
+		return *delta.New(nil).Retain(5, nil).Insert(" world", nil), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentText(t, s, original) != "hello world" || contentText(t, s, other) != "other" {
+		t.Errorf("Unexpected contents: %q %q", contentText(t, s, original), contentText(t, s, other))
+	}
+	// Remaining aliases keep working after the original ID is closed
+	s.CloseFiles(original)
+	if s.Content(original) != nil {
+		t.Errorf("File %d is not closed", original)
+	}
+	if aliases := s.Aliases(alias); !reflect.DeepEqual(aliases, []uint32{alias}) {
+		t.Errorf("Unexpected aliases of %d: %v", alias, aliases)
+	}
+	err = s.Update(alias, func(d delta.Delta) (delta.Delta, error) {
+		return *delta.New(nil).Insert(">> ", nil), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentText(t, s, alias) != ">> hello world" {
+		t.Errorf("Unexpected content: %q", contentText(t, s, alias))
+	}
+	if err := s.Undo(alias); err != nil || contentText(t, s, alias) != "hello world" {
+		t.Errorf("Unexpected content after undo: %q %v", contentText(t, s, alias), err)
+	}
+}
+
+// A change submitted through an alias is not echoed back to its sender for
+// that alias, while other aliases of the sender still receive it.
+func TestAliasEchoSuppression(t *testing.T) {
+	s := startServer(t)
+	original := s.CreateFiles(*delta.New(nil).Insert("hello", nil))[0]
+	alias := s.CreateAliasedFiles([]delta.Delta{{}}, []uint32{original})[0]
+	events := s.Connect(nil)
+	clientId := *(<-events).ConnectedClientId
+	<-events
+	s.Acks(clientId, map[uint32]uint32{0: 1, original: 1, alias: 1})
+	s.Submit(&clientId, ClientChange{
+		Id:            alias,
+		Base:          1,
+		ClientVersion: 1,
+		Delta:         *delta.New(nil).Retain(5, nil).Insert("!", nil),
+	})
+	event := <-events
+	expected := map[uint32]string{
+		// Sender already has the change in alias
+		alias:    "hello!",
+		original: "hello",
+	}
+	if len(event.Updates) != len(expected) {
+		t.Fatalf("Unexpected updates: %+v", event.Updates)
+	}
+	for _, update := range event.Updates {
+		content, ok := expected[update.Id]
+		if !ok {
+			t.Fatalf("Unexpected update: %+v", update)
+		}
+		result := text(*delta.New(nil).Insert(content, nil).Compose(update.Delta))
+		if result != "hello!" || update.Base != 1 || update.Version != 2 {
+			t.Errorf("Update of %d turns %q into %q at version %d", update.Id, content, result, update.Version)
+		}
+	}
+}